@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/duo/wechatgpt/chatgpt"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	defaultCredentialsFile = "credentials.json"
+
+	defaultAccountMaxFailures = 3
+	defaultAccountCooldown    = 10 * time.Minute
+)
+
+// loadAccounts reads ACCOUNTS_FILE, or builds a single account from the
+// legacy environment variables.
+func loadAccounts() []chatgpt.Account {
+	var accounts []chatgpt.Account
+
+	if path := os.Getenv("ACCOUNTS_FILE"); path != "" {
+		var err error
+		if accounts, err = chatgpt.LoadAccounts(path); err != nil {
+			log.Fatalf("Failed to load accounts: %v", err)
+		}
+	} else {
+		accounts = []chatgpt.Account{{
+			Email:        os.Getenv("CHATGPT_EMAIL"),
+			Password:     os.Getenv("CHATGPT_PASSWORD"),
+			SessionToken: os.Getenv("SESSION_TOKEN"),
+			UserAgent:    os.Getenv("USER_AGENT"),
+			CfClearance:  os.Getenv("CF_CLEARANCE"),
+			Proxy:        os.Getenv("CHATGPT_PROXY"),
+
+			APIAddr:        os.Getenv("CHATGPT_API_ADDR"),
+			BackendAPIAddr: os.Getenv("CHATGPT_BACKEND_API_ADDR"),
+			AuthAddr:       os.Getenv("CHATGPT_AUTH_ADDR"),
+			Auth0Addr:      os.Getenv("CHATGPT_AUTH0_ADDR"),
+		}}
+	}
+
+	for i := range accounts {
+		account := &accounts[i]
+
+		log.AddSecret(account.Password)
+		log.AddSecret(account.SessionToken)
+		log.AddSecret(account.CfClearance)
+
+		if account.Browser.Brand == "" {
+			account.Browser.Brand = os.Getenv("BROWSER")
+		}
+		if account.Browser.Version == "" {
+			account.Browser.Version = os.Getenv("BROWSER_VERSION")
+		}
+
+		if account.Name == "" {
+			if account.Email != "" {
+				account.Name = account.Email
+			} else {
+				account.Name = fmt.Sprintf("account%d", i+1)
+			}
+		}
+
+		if account.Email == "" && account.Password == "" && account.SessionToken == "" {
+			log.Fatalf("Login information of %s is missing", account.Name)
+		} else if account.SessionToken == "" && account.Email != "" && account.Password == "" {
+			log.Fatalf("Password of %s is empty", account.Name)
+		} else if account.SessionToken == "" && account.Email == "" && account.Password != "" {
+			log.Fatalf("Email of %s is empty", account.Name)
+		}
+	}
+
+	return accounts
+}
+
+func newPool(accounts []chatgpt.Account) *chatgpt.Pool {
+	credentialsFile := os.Getenv("CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = defaultCredentialsFile
+	}
+	credentialSecret := os.Getenv("CREDENTIALS_SECRET")
+	log.AddSecret(credentialSecret)
+	credentialStore := chatgpt.NewCredentialStore(credentialsFile, credentialSecret)
+
+	cooldown := defaultAccountCooldown
+	if value := os.Getenv("ACCOUNT_COOLDOWN"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cooldown = duration
+	}
+
+	pool := chatgpt.NewPool()
+	pool.SetHealthPolicy(getEnvInt("ACCOUNT_MAX_FAILURES", defaultAccountMaxFailures), cooldown)
+
+	for _, account := range accounts {
+		client, err := chatgpt.NewChatGPT(account)
+		if err != nil {
+			log.Fatalf("Invalid account %s: %v", account.Name, err)
+		}
+		if err := client.SetCredentialStore(credentialStore, account.Name); err != nil {
+			log.Fatalf("Failed to load credentials of %s: %v", account.Name, err)
+		}
+		pool.Add(account.Name, client)
+	}
+
+	return pool
+}
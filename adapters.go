@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/duo/wechatgpt/messaging"
+	"github.com/duo/wechatgpt/messaging/telegram"
+	"github.com/duo/wechatgpt/messaging/wechat"
+	"github.com/duo/wechatgpt/messaging/wecom"
+
+	"github.com/eatmoreapple/openwechat"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	adapterWeChat   = "wechat"
+	adapterTelegram = "telegram"
+	adapterWeCom    = "wecom"
+)
+
+// initAdapters creates the messaging adapters listed in ADAPTERS, WeChat
+// only by default.
+func initAdapters() []messaging.Adapter {
+	names := os.Getenv("ADAPTERS")
+	if names == "" {
+		names = adapterWeChat
+	}
+
+	var adapters []messaging.Adapter
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case adapterWeChat:
+			bot := openwechat.DefaultBot(openwechat.Desktop)
+			initLogin(bot)
+
+			adapter := wechat.New(bot, "storage.json")
+			adapter.SetAutoAccept(strings.ToLower(os.Getenv("AUTO_ACCEPT")) == "true")
+			adapter.SetLogoutOnStop(strings.ToLower(os.Getenv("SHUTDOWN_LOGOUT")) != "false")
+			adapters = append(adapters, adapter)
+		case adapterTelegram:
+			token := os.Getenv("TELEGRAM_BOT_TOKEN")
+			if token == "" {
+				log.Fatal("TELEGRAM_BOT_TOKEN is required by the telegram adapter")
+			}
+			adapters = append(adapters, telegram.New(os.Getenv("TELEGRAM_API_ADDR"), token))
+		case adapterWeCom:
+			adapters = append(adapters, newWeComAdapter())
+		default:
+			log.Fatalf("Unknown adapter: %s", name)
+		}
+	}
+
+	return adapters
+}
+
+// newWeComAdapter serves the WeCom callback at /wecom.
+func newWeComAdapter() *wecom.Adapter {
+	if os.Getenv("HTTP_ADDR") == "" {
+		log.Fatal("HTTP_ADDR is required by the wecom adapter")
+	}
+
+	config := wecom.Config{
+		APIAddr:        os.Getenv("WECOM_API_ADDR"),
+		CorpID:         os.Getenv("WECOM_CORP_ID"),
+		Secret:         os.Getenv("WECOM_SECRET"),
+		Token:          os.Getenv("WECOM_TOKEN"),
+		EncodingAESKey: os.Getenv("WECOM_AES_KEY"),
+	}
+	if config.CorpID == "" || config.Secret == "" || config.Token == "" || config.EncodingAESKey == "" {
+		log.Fatal("WECOM_CORP_ID, WECOM_AGENT_ID, WECOM_SECRET, WECOM_TOKEN and WECOM_AES_KEY are required by the wecom adapter")
+	}
+
+	agentID, err := strconv.ParseInt(os.Getenv("WECOM_AGENT_ID"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid WECOM_AGENT_ID: %v", err)
+	}
+	config.AgentID = agentID
+
+	adapter, err := wecom.New(config)
+	if err != nil {
+		log.Fatalf("Invalid WeCom config: %v", err)
+	}
+	httpMux.Handle("/wecom", adapter)
+
+	return adapter
+}
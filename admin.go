@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/duo/wechatgpt/chatgpt"
+	"github.com/duo/wechatgpt/messaging"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	cmdAdmin = "!admin"
+
+	adminReload     = "reload"
+	adminBan        = "ban"
+	adminUnban      = "unban"
+	adminStats      = "stats"
+	adminBroadcast  = "broadcast"
+	adminResetAll   = "reset-all"
+	adminSetTimeout = "set-timeout"
+
+	defaultBanStore = "banned.json"
+
+	adminUsage = `Usage:
+!admin reload
+!admin ban <user>
+!admin unban <user>
+!admin stats
+!admin broadcast <message>
+!admin reset-all
+!admin set-timeout <duration>`
+)
+
+var (
+	admins = map[string]bool{}
+
+	banStore   string
+	banned     = map[string]bool{}
+	bannedLock sync.RWMutex
+)
+
+func initAdmin() {
+	for _, id := range strings.Split(os.Getenv("ADMINS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			admins[id] = true
+		}
+	}
+
+	banStore = os.Getenv("BAN_STORE")
+	if banStore == "" {
+		banStore = defaultBanStore
+	}
+
+	if err := loadBanned(); err != nil {
+		log.Fatalf("Failed to load banned users: %v", err)
+	}
+}
+
+func isAdmin(id string) bool {
+	return admins[id]
+}
+
+func isBanned(id string) bool {
+	bannedLock.RLock()
+	defer bannedLock.RUnlock()
+
+	return banned[id]
+}
+
+func loadBanned() error {
+	data, err := os.ReadFile(banStore)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+
+	bannedLock.Lock()
+	defer bannedLock.Unlock()
+
+	banned = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		banned[id] = true
+	}
+
+	return nil
+}
+
+func setBanned(id string, ban bool) error {
+	bannedLock.Lock()
+	defer bannedLock.Unlock()
+
+	if ban {
+		banned[id] = true
+	} else {
+		delete(banned, id)
+	}
+
+	ids := make([]string, 0, len(banned))
+	for id := range banned {
+		ids = append(ids, id)
+	}
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	return chatgpt.WriteFileAtomic(banStore, data)
+}
+
+func isAdminCommand(content string) bool {
+	return content == cmdAdmin || strings.HasPrefix(content, cmdAdmin+" ")
+}
+
+func handleAdmin(msg *messaging.Message, taskManager *chatgpt.TaskManager, content string) {
+	sender := msg.Sender
+	if msg.Group != nil || !isAdmin(sender.ID) {
+		log.Warnf("Reject admin command from %s (%s)", sender.Name, sender.ID)
+		return
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(content, cmdAdmin))
+	if len(fields) == 0 {
+		replyText(msg, adminUsage)
+		return
+	}
+
+	args := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(content, cmdAdmin)), fields[0]))
+
+	log.Infof("Admin %s (%s) runs: %s", sender.Name, sender.ID, content)
+
+	switch fields[0] {
+	case adminReload:
+		if result, err := reloadConfig(taskManager); err != nil {
+			replyText(msg, fmt.Sprintf("[ERROR] Failed to reload\n\n%v", err))
+		} else {
+			replyText(msg, result)
+		}
+	case adminBan, adminUnban:
+		if args == "" {
+			replyText(msg, adminUsage)
+			return
+		}
+		id := msg.Adapter.ResolveUser(args)
+		if err := setBanned(id, fields[0] == adminBan); err != nil {
+			replyText(msg, fmt.Sprintf("[ERROR] Failed to %s %s\n\n%v", fields[0], id, err))
+		} else {
+			replyText(msg, fmt.Sprintf("%s %s done.", fields[0], id))
+		}
+	case adminStats:
+		replyText(msg, formatStats(taskManager.Stats()))
+	case adminBroadcast:
+		if args == "" {
+			replyText(msg, adminUsage)
+			return
+		}
+		go func() {
+			if err := msg.Adapter.Broadcast(args); err != nil {
+				replyText(msg, fmt.Sprintf("[ERROR] Failed to broadcast\n\n%v", err))
+			} else {
+				replyText(msg, "Broadcast done.")
+			}
+		}()
+	case adminResetAll:
+		taskManager.ResetAll()
+		replyText(msg, "Reset all conversations done.")
+	case adminSetTimeout:
+		duration, err := time.ParseDuration(args)
+		if err != nil || duration <= 0 {
+			replyText(msg, fmt.Sprintf("[ERROR] Invalid timeout: %s", args))
+			return
+		}
+		setTaskTimeout(duration)
+		replyText(msg, fmt.Sprintf("Task timeout set to %v.", duration))
+	default:
+		replyText(msg, adminUsage)
+	}
+}
+
+// reloadConfig re-reads the configuration files and describes the result.
+func reloadConfig(taskManager *chatgpt.TaskManager) (string, error) {
+	if err := loadBanned(); err != nil {
+		return "", err
+	}
+
+	if path := os.Getenv("QUOTA_CONFIG"); path != "" {
+		config, err := chatgpt.LoadQuotaConfig(path)
+		if err != nil {
+			return "", err
+		}
+		if !taskManager.SetQuotaConfig(config) {
+			return "Reload done, QUOTA_CONFIG skipped as quota was disabled at startup.", nil
+		}
+	}
+
+	return "Reload done.", nil
+}
+
+func formatStats(stats chatgpt.TaskStats) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Uptime: %v\n", time.Since(stats.StartedAt).Round(time.Second))
+	fmt.Fprintf(&sb, "Workers: %d\n", stats.Workers)
+	fmt.Fprintf(&sb, "Queued: %d\n", stats.Queued)
+	fmt.Fprintf(&sb, "Received: %d\n", stats.Received)
+	fmt.Fprintf(&sb, "Completed: %d\n", stats.Completed)
+	fmt.Fprintf(&sb, "Failed: %d\n", stats.Failed)
+	fmt.Fprintf(&sb, "Task timeout: %v", getTaskTimeout())
+	for _, account := range stats.Accounts {
+		status := "healthy"
+		if !account.Healthy {
+			status = fmt.Sprintf("cooling down until %s", account.UnhealthyUntil.Format("15:04:05"))
+		}
+		fmt.Fprintf(&sb, "\nAccount %s: %d conversations, %s", account.Name, account.Conversations, status)
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/duo/wechatgpt/chatgpt"
+
+	"github.com/google/uuid"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	apiModel       = "text-davinci-002-render"
+	apiDefaultUser = "default"
+
+	apiMaxBodySize        = 4 << 20
+	defaultAPIConcurrency = 4
+)
+
+type apiKey struct {
+	name string
+	key  []byte
+}
+
+type chatCompletionRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+	User     string        `json:"user"`
+}
+
+type chatMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatMessage `json:"message,omitempty"`
+	Delta        *chatMessage `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type chatCompletion struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *chatUsage   `json:"usage,omitempty"`
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type apiError struct {
+	Error struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+// initAPI serves an OpenAI compatible /v1/chat/completions on top of the
+// task manager for every key in API_KEYS (comma separated name:key pairs).
+// Like the OpenAI API it is stateless, every request is answered in a new
+// conversation from the messages it carries.
+func initAPI(taskManager *chatgpt.TaskManager) {
+	value := os.Getenv("API_KEYS")
+	if value == "" {
+		return
+	}
+	if os.Getenv("HTTP_ADDR") == "" {
+		log.Fatal("HTTP_ADDR is required by API_KEYS")
+	}
+
+	var keys []apiKey
+	for _, pair := range strings.Split(value, ",") {
+		name, key, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || name == "" || key == "" {
+			log.Fatalf("Invalid API_KEYS entry, expect name:key")
+		}
+		keys = append(keys, apiKey{name: name, key: []byte(key)})
+	}
+
+	concurrency := getEnvInt("API_CONCURRENCY", defaultAPIConcurrency)
+	if concurrency <= 0 {
+		log.Fatalf("Invalid API_CONCURRENCY: %d", concurrency)
+	}
+	taskManager.SetStatelessLimit(concurrency)
+
+	httpMux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+			return
+		}
+
+		name := authenticate(keys, r)
+		if name == "" {
+			writeAPIError(w, http.StatusUnauthorized, "invalid_request_error", "invalid API key")
+			return
+		}
+
+		var req chatCompletionRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodySize)).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		prompt, err := buildPrompt(req.Messages)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		serveCompletion(w, r, taskManager, name, &req, prompt)
+	})
+}
+
+// authenticate returns the name of the API key of r, or empty if invalid.
+func authenticate(keys []apiKey, r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(token), key.key) == 1 {
+			return key.name
+		}
+	}
+	return ""
+}
+
+// buildPrompt flattens messages into a single prompt: the system messages
+// first, then the last user message alone or, when there are earlier turns,
+// the whole exchange as a transcript.
+func buildPrompt(messages []chatMessage) (string, error) {
+	var system, turns []string
+	last := ""
+	for _, message := range messages {
+		switch message.Role {
+		case "system":
+			system = append(system, message.Content)
+			continue
+		case "user":
+			turns = append(turns, "User: "+message.Content)
+			last = message.Content
+		case "assistant":
+			turns = append(turns, "Assistant: "+message.Content)
+			last = ""
+		default:
+			return "", fmt.Errorf("unsupported role: %s", message.Role)
+		}
+	}
+
+	if strings.TrimSpace(last) == "" {
+		return "", errors.New("the last message must be a non-empty user message")
+	}
+
+	if len(turns) == 1 {
+		return strings.Join(append(system, last), "\n\n"), nil
+	}
+	return strings.Join(append(system, strings.Join(turns, "\n\n")+"\n\nAssistant:"), "\n\n"), nil
+}
+
+type completionResult struct {
+	resp string
+	err  error
+}
+
+func serveCompletion(w http.ResponseWriter, r *http.Request, taskManager *chatgpt.TaskManager, name string, req *chatCompletionRequest, prompt string) {
+	user := req.User
+	if user == "" {
+		user = apiDefaultUser
+	}
+	owner := "api:" + name
+	ctx := r.Context()
+
+	results := make(chan completionResult, 1)
+	// Only the latest partial answer matters, older ones are replaced
+	updates := make(chan string, 1)
+
+	task := chatgpt.NewTask(
+		owner+":"+user,
+		prompt,
+		getTaskTimeout(),
+		func(resp string, err error) {
+			results <- completionResult{resp, err}
+		},
+	).WithOwner(owner, "").WithContext(ctx).Stateless()
+	if req.Stream {
+		task.WithProgress(func(partial string) {
+			select {
+			case <-updates:
+			default:
+			}
+			updates <- partial
+		})
+	}
+	taskManager.SendTask(task)
+
+	completion := &chatCompletion{
+		ID:      "chatcmpl-" + uuid.NewString(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+	}
+	if completion.Model == "" {
+		completion.Model = apiModel
+	}
+
+	if !req.Stream {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				writeTaskError(w, result.err)
+				return
+			}
+			stop := "stop"
+			completion.Choices = []chatChoice{{
+				Message:      &chatMessage{Role: "assistant", Content: result.resp},
+				FinishReason: &stop,
+			}}
+			completion.Usage = &chatUsage{
+				PromptTokens:     chatgpt.EstimateTokens(prompt),
+				CompletionTokens: chatgpt.EstimateTokens(result.resp),
+			}
+			completion.Usage.TotalTokens = completion.Usage.PromptTokens + completion.Usage.CompletionTokens
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(completion)
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "server_error", "streaming is not supported")
+		return
+	}
+
+	completion.Object = "chat.completion.chunk"
+	started := false
+	sent := ""
+
+	send := func(delta *chatMessage, finishReason *string) {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			started = true
+		}
+		completion.Choices = []chatChoice{{Delta: delta, FinishReason: finishReason}}
+		data, _ := json.Marshal(completion)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	sendPartial := func(partial string) {
+		if !strings.HasPrefix(partial, sent) || len(partial) == len(sent) {
+			return
+		}
+		if !started {
+			send(&chatMessage{Role: "assistant"}, nil)
+		}
+		send(&chatMessage{Content: partial[len(sent):]}, nil)
+		sent = partial
+	}
+
+	for {
+		select {
+		case partial := <-updates:
+			sendPartial(partial)
+		case result := <-results:
+			if result.err != nil {
+				if !started {
+					writeTaskError(w, result.err)
+					return
+				}
+				log.Warnf("Failed to stream completion: %v", result.err)
+				// Tell the client the answer is cut short
+				var resp apiError
+				resp.Error.Message = result.err.Error()
+				resp.Error.Type = "server_error"
+				data, _ := json.Marshal(&resp)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				fmt.Fprintf(w, "data: [DONE]\n\n")
+				flusher.Flush()
+				return
+			}
+			sendPartial(result.resp)
+			stop := "stop"
+			send(&chatMessage{}, &stop)
+			fmt.Fprintf(w, "data: [DONE]\n\n")
+			flusher.Flush()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func writeTaskError(w http.ResponseWriter, err error) {
+	var statusErr *chatgpt.StatusError
+	switch {
+	case errors.Is(err, chatgpt.ErrQuotaExceeded):
+		writeAPIError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+	case errors.Is(err, chatgpt.ErrShuttingDown):
+		writeAPIError(w, http.StatusServiceUnavailable, "server_error", err.Error())
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+		writeAPIError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+	default:
+		writeAPIError(w, http.StatusBadGateway, "server_error", err.Error())
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, errType string, message string) {
+	var resp apiError
+	resp.Error.Message = message
+	resp.Error.Type = errType
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/duo/wechatgpt/chatgpt"
+	"github.com/duo/wechatgpt/messaging"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	captchaSolverStdin  = "stdin"
+	captchaSolverWeChat = "wechat"
+	captchaSolverHTTP   = "http"
+
+	defaultCaptchaTimeout = 5 * time.Minute
+
+	cmdCaptcha    = "!captcha"
+	captchaPrompt = "ChatGPT login needs a captcha, reply with \"" + cmdCaptcha + " <answer>\"."
+)
+
+var (
+	captchaAdmin  string
+	wechatCaptcha *chatgpt.AsyncCaptchaSolver
+)
+
+// initCaptcha sets up the captcha solver, CAPTCHA_SOLVER=wechat sends the
+// captcha to CAPTCHA_ADMIN through the WeChat adapter.
+func initCaptcha(adapters []messaging.Adapter, taskManager *chatgpt.TaskManager) {
+	timeout := defaultCaptchaTimeout
+	if value := os.Getenv("CAPTCHA_TIMEOUT"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		timeout = duration
+	}
+
+	switch solver := strings.ToLower(os.Getenv("CAPTCHA_SOLVER")); solver {
+	case "", captchaSolverStdin:
+		return
+	case captchaSolverWeChat:
+		captchaAdmin = os.Getenv("CAPTCHA_ADMIN")
+		if captchaAdmin == "" {
+			captchaAdmin = strings.TrimSpace(strings.Split(os.Getenv("ADMINS"), ",")[0])
+		}
+		if captchaAdmin == "" {
+			log.Fatal("CAPTCHA_ADMIN or ADMINS is required by CAPTCHA_SOLVER=wechat")
+		}
+
+		var adapter messaging.Adapter
+		for _, a := range adapters {
+			if a.Name() == captchaSolverWeChat {
+				adapter = a
+			}
+		}
+		if adapter == nil {
+			log.Fatal("CAPTCHA_SOLVER=wechat requires the wechat adapter")
+		}
+
+		wechatCaptcha = chatgpt.NewAsyncCaptchaSolver(func(ctx context.Context, png []byte) error {
+			return sendCaptchaToAdmin(adapter, png)
+		})
+		taskManager.SetCaptchaSolver(wechatCaptcha, timeout)
+	case captchaSolverHTTP:
+		if os.Getenv("HTTP_ADDR") == "" {
+			log.Fatal("HTTP_ADDR is required by CAPTCHA_SOLVER=http")
+		}
+
+		httpCaptcha := chatgpt.NewHTTPCaptchaSolver()
+		httpMux.Handle("/captcha", requireAdmin(httpCaptcha))
+		taskManager.SetCaptchaSolver(httpCaptcha, timeout)
+	default:
+		log.Fatalf("Unknown CAPTCHA_SOLVER: %s", solver)
+	}
+}
+
+func sendCaptchaToAdmin(adapter messaging.Adapter, png []byte) error {
+	if err := adapter.SendImage(captchaAdmin, png); err != nil {
+		return err
+	}
+
+	return adapter.SendText(captchaAdmin, captchaPrompt)
+}
+
+// answerCaptcha takes a "!captcha <answer>" private message of the captcha
+// admin as the answer of the pending captcha, other messages are left to
+// the caller.
+func answerCaptcha(msg *messaging.Message, senderID string, content string) bool {
+	if wechatCaptcha == nil || senderID != captchaAdmin {
+		return false
+	}
+
+	if !strings.HasPrefix(content, cmdCaptcha+" ") {
+		return false
+	}
+
+	if wechatCaptcha.Answer(strings.TrimPrefix(content, cmdCaptcha+" ")) {
+		replyText(msg, "Captcha answer received")
+	} else {
+		replyText(msg, "No captcha is waiting for an answer")
+	}
+	return true
+}
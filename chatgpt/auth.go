@@ -12,11 +12,17 @@ import (
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
-	"github.com/rs/zerolog"
 	http "github.com/saucesteals/fhttp"
 	"github.com/saucesteals/fhttp/cookiejar"
 	"github.com/saucesteals/mimic"
 	"github.com/tidwall/gjson"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	DefaultAuthAddr  = "https://chat.openai.com"
+	DefaultAuth0Addr = "https://auth0.openai.com"
 )
 
 type Credentials struct {
@@ -30,32 +36,37 @@ type Auth struct {
 	Password     string
 	userAgent    string
 	state        string
+	chatAddr     string
+	auth0Addr    string
 	session      *http.Client
 	m            *mimic.ClientSpec
-	logger       *zerolog.Logger
+	logger       *log.Entry
 }
 
 // NewAuthClient creates a new authenticator, performing valiation on the parameters.
-// If the logger pointer is nil, a NOOP logger is used.
-func NewAuthClient(email, password, proxy string, logger *zerolog.Logger) (auth *Auth, err error) {
-	jar, _ := cookiejar.New(nil)
-	userAgent := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36"
-	m, _ := mimic.Chromium(mimic.BrandChrome, "107.0.0.0")
+// If the logger pointer is nil, the auth component logger is used.
+func NewAuthClient(email, password, proxy string, logger *log.Entry) (auth *Auth, err error) {
+	return NewAuthClientWithBrowser(email, password, proxy, DefaultBrowser, DefaultBrowser.UserAgent(), logger)
+}
 
-	var lg *zerolog.Logger
+// NewAuthClientWithBrowser creates a new authenticator emulating browser.
+func NewAuthClientWithBrowser(email, password, proxy string, browser Browser, userAgent string, logger *log.Entry) (auth *Auth, err error) {
+	jar, _ := cookiejar.New(nil)
+	m, err := browser.spec()
+	if err != nil {
+		return nil, err
+	}
 
-	if logger == nil {
-		l := zerolog.Nop()
-		lg = &l
-	} else {
-		lg = logger
+	lg := logger
+	if lg == nil {
+		lg = log.Component("auth")
 	}
 
-	lg.Info().Msg("Creating auth client")
+	lg.Info("Creating auth client")
 
 	defer func() {
 		if err != nil {
-			lg.Error().Err(err).Msg("")
+			lg.WithError(err).Error("Failed to create auth client")
 		}
 	}()
 
@@ -70,14 +81,27 @@ func NewAuthClient(email, password, proxy string, logger *zerolog.Logger) (auth
 		newClient = &http.Client{Jar: jar, Transport: m.ConfigureTransport(&http.Transport{Proxy: http.ProxyFromEnvironment})}
 	}
 
-	return &Auth{EmailAddress: email, Password: password, userAgent: userAgent, session: newClient, m: m, logger: lg}, nil
+	return &Auth{EmailAddress: email, Password: password, userAgent: userAgent, chatAddr: DefaultAuthAddr, auth0Addr: DefaultAuth0Addr, session: newClient, m: m, logger: lg}, nil
+}
+
+// SetEndpoints replaces the ChatGPT and auth0 origins used by the login
+// flow, for a reverse proxy or a fake server.
+func (a *Auth) SetEndpoints(chatAddr, auth0Addr string) {
+	if chatAddr != "" {
+		a.chatAddr = strings.TrimSuffix(chatAddr, "/")
+	}
+	if auth0Addr != "" {
+		a.auth0Addr = strings.TrimSuffix(auth0Addr, "/")
+	}
 }
 
 func (a *Auth) performGet(url string, headers http.Header) (resp *http.Response, body []byte, statusCode int, err error) {
-	a.logger.Debug().Interface("headers", headers).Str("url", url).Str("method", "GET").Msg("Starting request")
+	// Headers, queries and bodies carry cookies, codes and tokens, which
+	// are never logged
+	a.logger.WithFields(log.Fields{"url": strings.SplitN(url, "?", 2)[0], "method": "GET"}).Debug("Starting request")
 	defer func() {
 		if err != nil {
-			a.logger.Error().Err(err).Msg("performGet failed")
+			a.logger.WithError(err).Error("performGet failed")
 		}
 	}()
 
@@ -105,7 +129,7 @@ func (a *Auth) performGet(url string, headers http.Header) (resp *http.Response,
 		return nil, nil, 0, err
 	}
 
-	a.logger.Debug().Int("status", resp.StatusCode).Bytes("body", body).Msg("request successful")
+	a.logger.WithFields(log.Fields{"status": resp.StatusCode, "size": len(body)}).Debug("request successful")
 
 	return resp, body, resp.StatusCode, nil
 }
@@ -116,7 +140,7 @@ func (a *Auth) performPost(url string, headers http.Header, query url.Values, re
 
 	defer func() {
 		if err != nil {
-			a.logger.Error().Err(err).Msg("performPost failed")
+			a.logger.WithError(err).Error("performPost failed")
 		}
 	}()
 
@@ -146,7 +170,7 @@ func (a *Auth) performPost(url string, headers http.Header, query url.Values, re
 }
 
 func (a *Auth) begin() error {
-	endpoint := "https://chat.openai.com/auth/login"
+	endpoint := a.chatAddr + "/auth/login"
 
 	headers := http.Header{
 		"sec-ch-ua":                 {a.m.ClientHintUA()},
@@ -180,7 +204,7 @@ func (a *Auth) begin() error {
 }
 
 func (a *Auth) getCsrf() (token string, err error) {
-	endpoint := "https://chat.openai.com/api/auth/csrf"
+	endpoint := a.chatAddr + "/api/auth/csrf"
 
 	headers := http.Header{
 		"sec-ch-ua":          {a.m.ClientHintUA()},
@@ -218,7 +242,7 @@ func (a *Auth) getCsrf() (token string, err error) {
 }
 
 func (a *Auth) postLoginPrompt(token string) (nextUrl string, err error) {
-	endpoint := "https://chat.openai.com/api/auth/signin/auth0"
+	endpoint := a.chatAddr + "/api/auth/signin/auth0"
 
 	headers := http.Header{
 		"sec-ch-ua":          {a.m.ClientHintUA()},
@@ -312,7 +336,7 @@ func (a *Auth) auth0AuthorizeAndIdentifier(endpoint string) (state string, captc
 		challange, exists := doc.Find("img[alt='captcha']").First().Attr("src")
 
 		if exists {
-			a.logger.Info().Msg("Captcha detected")
+			a.logger.Info("Captcha detected")
 			return state, Captcha(challange), nil
 		}
 
@@ -323,7 +347,7 @@ func (a *Auth) auth0AuthorizeAndIdentifier(endpoint string) (state string, captc
 }
 
 func (a *Auth) postUserName(state, captcha string) error {
-	endpoint := "https://auth0.openai.com/u/login/identifier"
+	endpoint := a.auth0Addr + "/u/login/identifier"
 
 	headers := http.Header{
 		"cache-control":             {"max-age=0"},
@@ -379,7 +403,7 @@ func (a *Auth) postUserName(state, captcha string) error {
 
 func (a *Auth) postPassword(state string) (newState string, err error) {
 
-	endpoint := "https://auth0.openai.com/u/login/password"
+	endpoint := a.auth0Addr + "/u/login/password"
 
 	headers := http.Header{
 		"cache-control":             {"max-age=0"},
@@ -433,7 +457,7 @@ func (a *Auth) postPassword(state string) (newState string, err error) {
 }
 
 func (a *Auth) resumeSession(newState, oldState string) (nextUrl string, err error) {
-	endpoint := "https://auth0.openai.com/authorize/resume?state=" + newState
+	endpoint := a.auth0Addr + "/authorize/resume?state=" + newState
 
 	headers := http.Header{
 		"cache-control":             {"max-age=0"},
@@ -508,7 +532,7 @@ func (a *Auth) authCallback(endpoint string) (token string, err error) {
 
 		nextData := doc.Find("#__NEXT_DATA__").First().Text()
 
-		a.logger.Debug().Str("__NEXT_DATA__", nextData).Msg("")
+		a.logger.WithField("size", len(nextData)).Debug("Got next data")
 
 		if !gjson.Valid(nextData) {
 			return "", errors.New("authCallback: invalid __NEXT_DATA__ json")
@@ -527,7 +551,7 @@ func (a *Auth) authCallback(endpoint string) (token string, err error) {
 }
 
 func (a *Auth) authSession() (creds *Credentials, err error) {
-	endpoint := "https://chat.openai.com/api/auth/session"
+	endpoint := a.chatAddr + "/api/auth/session"
 
 	headers := http.Header{
 		"sec-ch-ua":          {a.m.ClientHintUA()},
@@ -571,7 +595,7 @@ func (a *Auth) authSession() (creds *Credentials, err error) {
 func (a *Auth) Begin() (captcha Captcha, err error) {
 	defer func() {
 		if err != nil {
-			a.logger.Error().Err(err).Msg("failed to authenticate")
+			a.logger.WithError(err).Error("failed to authenticate")
 		}
 	}()
 
@@ -579,7 +603,7 @@ func (a *Auth) Begin() (captcha Captcha, err error) {
 		return "", errors.New("invalid credentials")
 	}
 
-	a.logger.Info().Str("password", a.Password).Str("username", a.EmailAddress).Msg("Starting authentication process")
+	a.logger.WithField("username", a.EmailAddress).Info("Starting authentication process")
 
 	err = a.begin()
 
@@ -587,7 +611,7 @@ func (a *Auth) Begin() (captcha Captcha, err error) {
 		return "", err
 	}
 
-	a.logger.Info().Msg("Got main page")
+	a.logger.Info("Got main page")
 
 	csrfToken, err := a.getCsrf()
 
@@ -595,7 +619,7 @@ func (a *Auth) Begin() (captcha Captcha, err error) {
 		return "", err
 	}
 
-	a.logger.Info().Str("token", csrfToken).Msg("Got CSRF token")
+	a.logger.Info("Got CSRF token")
 
 	nextUrl, err := a.postLoginPrompt(csrfToken)
 
@@ -603,7 +627,7 @@ func (a *Auth) Begin() (captcha Captcha, err error) {
 		return "", err
 	}
 
-	a.logger.Info().Str("url", nextUrl).Msg("Got auth0 URL")
+	a.logger.WithField("url", nextUrl).Info("Got auth0 URL")
 
 	firstState, captcha, err := a.auth0AuthorizeAndIdentifier(nextUrl)
 
@@ -613,7 +637,7 @@ func (a *Auth) Begin() (captcha Captcha, err error) {
 		return "", err
 	}
 
-	a.logger.Info().Bool("hasCaptcha", captcha.Available()).Msg("Got auth0 authorization")
+	a.logger.WithField("hasCaptcha", captcha.Available()).Info("Got auth0 authorization")
 
 	return captcha, nil
 
@@ -642,18 +666,18 @@ func (a *Auth) Finish(captcha string) (cred *Credentials, err error) {
 		return nil, err
 	}
 
-	a.logger.Info().Msg("Username sent")
+	a.logger.Info("Username sent")
 
 	newState, err := a.postPassword(a.state)
 
 	if err != nil {
 		return nil, err
 	}
-	a.logger.Info().Msg("Password sent")
+	a.logger.Info("Password sent")
 
 	nextUrl, err := a.resumeSession(newState, a.state)
 
-	a.logger.Info().Msg("Session resumed")
+	a.logger.Info("Session resumed")
 
 	if err != nil {
 		return nil, err
@@ -661,13 +685,13 @@ func (a *Auth) Finish(captcha string) (cred *Credentials, err error) {
 
 	a.session.CheckRedirect = oldCheckRedirect // go doens't break the redirect chain in this request
 
-	token, err := a.authCallback(nextUrl)
+	_, err = a.authCallback(nextUrl)
 
 	if err != nil {
 		return nil, err
 	}
 
-	a.logger.Info().Str("token", token).Msg("Logged in")
+	a.logger.Info("Logged in")
 
 	creds, err := a.authSession()
 
@@ -675,7 +699,22 @@ func (a *Auth) Finish(captcha string) (cred *Credentials, err error) {
 		return nil, err
 	}
 
-	a.logger.Debug().Str("access token", creds.AccessToken).Str("expiration", creds.ExpiresAt.String()).Msg("got creds")
+	a.logger.WithField("expiration", creds.ExpiresAt.String()).Debug("got creds")
 
 	return creds, nil
 }
+
+// SessionToken returns the next-auth session cookie set by a successful
+// Finish, it can be used to refresh the access token without logging in.
+func (a *Auth) SessionToken() string {
+	u, err := url.Parse(a.chatAddr + "/")
+	if err != nil {
+		return ""
+	}
+	for _, cookie := range a.session.Jar.Cookies(u) {
+		if cookie.Name == cookieSessionToken {
+			return cookie.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package chatgpt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/saucesteals/mimic"
+)
+
+const (
+	defaultBrowserVersion = "107.0.0.0"
+
+	brandEdge = "Microsoft Edge"
+)
+
+// Browser is the Chromium based browser emulated by the TLS fingerprint,
+// the HTTP/2 settings and the headers of every request.
+type Browser struct {
+	Brand   string `json:"brand"`
+	Version string `json:"version"`
+}
+
+var DefaultBrowser = Browser{
+	Brand:   string(mimic.BrandChrome),
+	Version: defaultBrowserVersion,
+}
+
+func (b Browser) withDefaults() Browser {
+	if b.Brand == "" {
+		b.Brand = DefaultBrowser.Brand
+	}
+	if b.Version == "" {
+		b.Version = DefaultBrowser.Version
+	}
+	return b
+}
+
+func (b Browser) spec() (*mimic.ClientSpec, error) {
+	b = b.withDefaults()
+
+	m, err := mimic.Chromium(mimic.Brand(b.Brand), b.Version)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported browser %s %s: %w", b.Brand, b.Version, err)
+	}
+	return m, nil
+}
+
+// UserAgent returns the Windows user agent of the browser.
+func (b Browser) UserAgent() string {
+	b = b.withDefaults()
+
+	ua := fmt.Sprintf("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/%s Safari/537.36", b.Version)
+	if strings.EqualFold(b.Brand, brandEdge) {
+		ua += " Edg/" + b.Version
+	}
+	return ua
+}
@@ -0,0 +1,309 @@
+// Package chatgpttest provides an in-process fake of the ChatGPT web API
+// for tests, speaking the session and conversation protocols.
+package chatgpttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionToken is the session token accepted by the server.
+	SessionToken = "fake-session-token"
+
+	sessionCookie = "__Secure-next-auth.session-token"
+	tokenLifetime = time.Hour
+)
+
+// Reply scripts the answer of one conversation request, the zero value
+// echoes the message in a few frames.
+type Reply struct {
+	// Status answers with this status code and Body instead of a stream
+	Status int
+	Body   string
+
+	// Delay is waited before answering, FrameDelay between frames
+	Delay      time.Duration
+	FrameDelay time.Duration
+
+	// Frames are the answer streamed so far by each event, they default to
+	// the growing prefixes of Answer
+	Frames []string
+	// Answer defaults to "echo: <message>"
+	Answer string
+
+	// Error is sent as the error of the last event
+	Error string
+	// Truncate closes the stream in the middle of the last event without
+	// the [DONE] event
+	Truncate bool
+}
+
+// Request is a conversation request received by the server.
+type Request struct {
+	AccessToken     string
+	ConversationID  string
+	ParentMessageID string
+	MessageID       string
+	Message         string
+}
+
+type conversationRequest struct {
+	Action   string `json:"action"`
+	Messages []struct {
+		ID      string `json:"id"`
+		Role    string `json:"role"`
+		Content struct {
+			ContentType string   `json:"content_type"`
+			Parts       []string `json:"parts"`
+		} `json:"content"`
+	} `json:"messages"`
+	ConversationID  string `json:"conversation_id"`
+	ParentMessageID string `json:"parent_message_id"`
+}
+
+// Server answers the session endpoint with a new access token for every
+// call carrying SessionToken, and streams scripted replies to the
+// conversation requests authorized by one of them.
+type Server struct {
+	*httptest.Server
+
+	lock          sync.Mutex
+	replies       []Reply
+	requests      []Request
+	sessionCalls  int
+	sessionStatus int
+	accessTokens  map[string]bool
+	ids           int
+}
+
+// NewServer starts a fake server, it must be closed after use.
+func NewServer() *Server {
+	s := &Server{accessTokens: make(map[string]bool)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/auth/session", s.handleSession)
+	mux.HandleFunc("/backend-api/conversation", s.handleConversation)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// APIAddr is the api_addr of the fake.
+func (s *Server) APIAddr() string {
+	return s.URL + "/api"
+}
+
+// BackendAPIAddr is the backend_api_addr of the fake.
+func (s *Server) BackendAPIAddr() string {
+	return s.URL + "/backend-api"
+}
+
+// Enqueue scripts the replies of the next conversation requests, in order.
+func (s *Server) Enqueue(replies ...Reply) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.replies = append(s.replies, replies...)
+}
+
+// ExpireTokens makes every issued access token invalid, conversation
+// requests are answered with 401 until a new one is fetched.
+func (s *Server) ExpireTokens() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.accessTokens = make(map[string]bool)
+}
+
+// SetSessionStatus makes the session endpoint answer with status, 0 restores
+// normal answers.
+func (s *Server) SetSessionStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessionStatus = status
+}
+
+// Requests returns the conversation requests received so far.
+func (s *Server) Requests() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// SessionCalls returns how many times the session endpoint was called.
+func (s *Server) SessionCalls() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.sessionCalls
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessionCalls++
+
+	if s.sessionStatus != 0 {
+		http.Error(w, http.StatusText(s.sessionStatus), s.sessionStatus)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value != SessionToken {
+		// The real server answers an empty session
+		w.Write([]byte("{}"))
+		return
+	}
+
+	token := s.newID("access-token")
+	s.accessTokens[token] = true
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accessToken": token,
+		"expires":     time.Now().Add(tokenLifetime).UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *Server) handleConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req conversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Messages) == 0 || len(req.Messages[0].Content.Parts) == 0 {
+		http.Error(w, `{"detail":"invalid request"}`, http.StatusBadRequest)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	message := req.Messages[0]
+
+	s.lock.Lock()
+	s.requests = append(s.requests, Request{
+		AccessToken:     token,
+		ConversationID:  req.ConversationID,
+		ParentMessageID: req.ParentMessageID,
+		MessageID:       message.ID,
+		Message:         message.Content.Parts[0],
+	})
+
+	authorized := s.accessTokens[token]
+
+	var reply Reply
+	if authorized && len(s.replies) > 0 {
+		reply = s.replies[0]
+		s.replies = s.replies[1:]
+	}
+
+	conversationID := req.ConversationID
+	if conversationID == "" {
+		conversationID = s.newID("conversation")
+	}
+	messageID := s.newID("message")
+	s.lock.Unlock()
+
+	if !authorized {
+		http.Error(w, `{"detail":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if !sleep(r, reply.Delay) {
+		return
+	}
+
+	if reply.Status != 0 {
+		http.Error(w, reply.Body, reply.Status)
+		return
+	}
+
+	frames := reply.Frames
+	if len(frames) == 0 {
+		answer := reply.Answer
+		if answer == "" {
+			answer = "echo: " + message.Content.Parts[0]
+		}
+		frames = prefixes(answer)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+
+	for i, frame := range frames {
+		if i > 0 && !sleep(r, reply.FrameDelay) {
+			return
+		}
+
+		event := map[string]interface{}{
+			"message": map[string]interface{}{
+				"id":      messageID,
+				"role":    "assistant",
+				"content": map[string]interface{}{"content_type": "text", "parts": []string{frame}},
+			},
+			"conversation_id": conversationID,
+			"error":           nil,
+		}
+		last := i == len(frames)-1
+		if last && reply.Error != "" {
+			event["message"] = nil
+			event["error"] = reply.Error
+		}
+
+		data, _ := json.Marshal(event)
+		if last && reply.Truncate {
+			fmt.Fprintf(w, "data: %s", data[:len(data)/2])
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func (s *Server) newID(kind string) string {
+	s.ids++
+	return fmt.Sprintf("fake-%s-%d", kind, s.ids)
+}
+
+// sleep waits d unless the client goes away first.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// prefixes splits answer in three growing frames like the real stream.
+func prefixes(answer string) []string {
+	runes := []rune(answer)
+	if len(runes) < 3 {
+		return []string{answer}
+	}
+
+	return []string{
+		string(runes[:len(runes)/3]),
+		string(runes[:2*len(runes)/3]),
+		answer,
+	}
+}
@@ -5,22 +5,28 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	http "github.com/saucesteals/fhttp"
+	"github.com/saucesteals/mimic"
+
+	"github.com/duo/wechatgpt/metrics"
+
+	log "github.com/duo/wechatgpt/logging"
 )
 
 const (
-	apiAddr        = "https://chat.openai.com/api"
-	backendAPIAddr = "https://chat.openai.com/backend-api"
+	DefaultAPIAddr        = "https://chat.openai.com/api"
+	DefaultBackendAPIAddr = "https://chat.openai.com/backend-api"
 
-	userAgent          = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/107.0.0.0 Safari/537.36"
+	chatOrigin         = "https://chat.openai.com"
 	cookieSessionToken = "__Secure-next-auth.session-token"
 	cookieCfClearance  = "cf_clearance"
 
@@ -31,44 +37,132 @@ const (
 
 	dataPrefix      = "data: "
 	conversationEOF = "[DONE]"
+
+	defaultCaptchaTimeout = 5 * time.Minute
+
+	accessTokenRefreshMargin = 5 * time.Minute
+	refreshTimeout           = 2 * time.Minute
 )
 
 type ChatGPT struct {
-	httpClient         *http.Client
-	email              string
-	password           string
-	sessionToken       string
-	userAgent          string
-	cfClearance        string
+	httpClient     *http.Client
+	email          string
+	password       string
+	sessionToken   string
+	userAgent      string
+	cfClearance    string
+	proxy          string
+	apiAddr        string
+	backendAPIAddr string
+	authAddr       string
+	auth0Addr      string
+	browser        Browser
+	m              *mimic.ClientSpec
+	captchaSolver  CaptchaSolver
+	captchaTimeout time.Duration
+
+	credentialStore   *CredentialStore
+	credentialAccount string
+	// configuredSessionToken is tried when the restored session token is
+	// rejected
+	configuredSessionToken string
+
+	tokenLock          sync.Mutex
 	accessToken        string
 	accessTokenExpires time.Time
+	refreshCall        *refreshCall
 }
 
-func NewChatGPT(email, password, sessionToken, userAgent, cfClearance string) *ChatGPT {
-	return NewChatGPTWithClient(
-		email,
-		password,
-		sessionToken,
-		userAgent,
-		cfClearance,
+type refreshCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// NewChatGPT creates a client for account, both the conversation requests
+// and the password login go through the proxy of the account if any, with
+// the TLS fingerprint and headers of the browser of the account.
+func NewChatGPT(account Account) (*ChatGPT, error) {
+	m, err := account.Browser.spec()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if account.Proxy != "" {
+		proxyURL, err := ParseProxy(account.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	c := NewChatGPTWithClient(
+		account.Email,
+		account.Password,
+		account.SessionToken,
+		account.UserAgent,
+		account.CfClearance,
 		&http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-			},
+			Transport: m.ConfigureTransport(&http.Transport{
+				Proxy: proxy,
+			}),
 		})
+	c.proxy = account.Proxy
+	c.SetEndpoints(account.APIAddr, account.BackendAPIAddr, account.AuthAddr, account.Auth0Addr)
+	c.browser = account.Browser.withDefaults()
+	c.m = m
+
+	return c, nil
 }
 
+// NewChatGPTWithClient creates a client using httpClient as is, the headers
+// are the ones of DefaultBrowser.
 func NewChatGPTWithClient(email, password, sessionToken, userAgent, cfClearance string, httpClient *http.Client) *ChatGPT {
+	m, _ := DefaultBrowser.spec()
+
 	return &ChatGPT{
-		email:        email,
-		password:     password,
-		sessionToken: sessionToken,
-		userAgent:    userAgent,
-		cfClearance:  cfClearance,
-		httpClient:   httpClient,
+		email:          email,
+		password:       password,
+		sessionToken:   sessionToken,
+		userAgent:      userAgent,
+		cfClearance:    cfClearance,
+		httpClient:     httpClient,
+		apiAddr:        DefaultAPIAddr,
+		backendAPIAddr: DefaultBackendAPIAddr,
+		authAddr:       DefaultAuthAddr,
+		auth0Addr:      DefaultAuth0Addr,
+		browser:        DefaultBrowser,
+		m:              m,
+		captchaSolver:  NewStdinCaptchaSolver(),
+		captchaTimeout: defaultCaptchaTimeout,
 	}
 }
 
+// SetEndpoints points the client to a reverse proxy (or a fake server),
+// empty addresses keep their current value.
+func (c *ChatGPT) SetEndpoints(apiAddr, backendAPIAddr, authAddr, auth0Addr string) {
+	if apiAddr != "" {
+		c.apiAddr = apiAddr
+	}
+	if backendAPIAddr != "" {
+		c.backendAPIAddr = backendAPIAddr
+	}
+	if authAddr != "" {
+		c.authAddr = authAddr
+	}
+	if auth0Addr != "" {
+		c.auth0Addr = auth0Addr
+	}
+}
+
+// SetCaptchaSolver sets how captcha challenges of password login are
+// answered and how long to wait for an answer.
+func (c *ChatGPT) SetCaptchaSolver(solver CaptchaSolver, timeout time.Duration) {
+	c.captchaSolver = solver
+	c.captchaTimeout = timeout
+}
+
 func (c *ChatGPT) NewConversation(conversationId string) *Conversation {
 	return &Conversation{
 		ChatGPT:         c,
@@ -77,102 +171,303 @@ func (c *ChatGPT) NewConversation(conversationId string) *Conversation {
 	}
 }
 
-func (c *ChatGPT) refreshAccessTokenIfExpired(ctx context.Context) error {
-	if c.accessToken == "" || time.Now().After(c.accessTokenExpires) {
-		//if c.email != "" && c.password != "" {
-		if c.sessionToken == "" {
-			return c.refreshAccessTokenByPassword(ctx)
-		} else {
-			return c.refreshAccessTokenBySessionToken(ctx)
+// getAccessToken returns a valid access token, refreshing it when expired.
+// Concurrent callers share a single refresh, and a token about to expire
+// is refreshed in background while the current one is still served.
+func (c *ChatGPT) getAccessToken(ctx context.Context) (string, error) {
+	c.tokenLock.Lock()
+
+	now := time.Now()
+	if c.accessToken != "" && now.Before(c.accessTokenExpires) {
+		token := c.accessToken
+		if now.Add(accessTokenRefreshMargin).After(c.accessTokenExpires) {
+			c.startRefreshLocked()
 		}
+		c.tokenLock.Unlock()
+		return token, nil
 	}
 
-	return nil
+	call := c.startRefreshLocked()
+	c.tokenLock.Unlock()
+
+	select {
+	case <-call.done:
+		if call.err != nil {
+			return "", call.err
+		}
+		return call.token, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// invalidateAccessToken drops token if it is still the current one, so the
+// next request performs a refresh.
+func (c *ChatGPT) invalidateAccessToken(token string) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if c.accessToken == token {
+		c.accessToken = ""
+	}
 }
 
-func (c *ChatGPT) refreshAccessTokenByPassword(ctx context.Context) error {
-	auth, err := NewAuthClient(c.email, c.password, "", nil)
+// TokenExpires returns when the current access token expires, zero if there
+// is none.
+func (c *ChatGPT) TokenExpires() time.Time {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if c.accessToken == "" {
+		return time.Time{}
+	}
+	return c.accessTokenExpires
+}
+
+// startRefreshLocked starts a refresh unless one is in flight, the caller
+// must hold tokenLock.
+func (c *ChatGPT) startRefreshLocked() *refreshCall {
+	if c.refreshCall != nil {
+		return c.refreshCall
+	}
+
+	call := &refreshCall{done: make(chan struct{})}
+	c.refreshCall = call
+
+	go func() {
+		// Detached from the caller, an abandoned wait must not abort a
+		// login other workers are waiting on.
+		ctx, cancel := context.WithTimeout(context.Background(), c.captchaTimeout+refreshTimeout)
+		defer cancel()
+
+		creds, err := c.refreshAccessToken(ctx)
+		metrics.TokenRefreshes.WithLabelValues(metrics.Result(err)).Inc()
+
+		c.tokenLock.Lock()
+		if err == nil {
+			log.AddSecret(creds.AccessToken)
+			log.AddSecret(c.sessionToken)
+			c.accessToken = creds.AccessToken
+			c.accessTokenExpires = creds.ExpiresAt
+			call.token = creds.AccessToken
+		}
+		call.err = err
+		c.refreshCall = nil
+		c.tokenLock.Unlock()
+
+		close(call.done)
+	}()
+
+	return call
+}
+
+// refreshAccessToken prefers the session token, password login is only
+// performed when there is none or it does not work anymore.
+func (c *ChatGPT) refreshAccessToken(ctx context.Context) (*Credentials, error) {
+	current := c.sessionToken
+	var lastErr error
+	for _, sessionToken := range c.sessionTokens() {
+		c.sessionToken = sessionToken
+		creds, err := c.refreshAccessTokenBySessionToken(ctx)
+		if err == nil {
+			c.saveCredentials(creds)
+			return creds, nil
+		}
+		log.Warnf("Failed to refresh access token by session token: %v", err)
+		lastErr = err
+	}
+	c.sessionToken = current
+	if lastErr != nil && (c.email == "" || c.password == "") {
+		return nil, lastErr
+	}
+
+	creds, err := c.refreshAccessTokenByPassword(ctx)
 	if err != nil {
+		return nil, err
+	}
+	c.saveCredentials(creds)
+
+	return creds, nil
+}
+
+// sessionTokens returns the session tokens to try, the current one first
+// and then the configured one if it differs.
+func (c *ChatGPT) sessionTokens() []string {
+	var tokens []string
+	if c.sessionToken != "" {
+		tokens = append(tokens, c.sessionToken)
+	}
+	if c.configuredSessionToken != "" && c.configuredSessionToken != c.sessionToken {
+		tokens = append(tokens, c.configuredSessionToken)
+	}
+	return tokens
+}
+
+// SetCredentialStore persists the credentials of this client under account,
+// and restores the ones saved by a previous run. The configured session
+// token is kept as a fallback of the restored one.
+func (c *ChatGPT) SetCredentialStore(store *CredentialStore, account string) error {
+	c.credentialStore = store
+	c.credentialAccount = account
+
+	stored, err := store.Load(account)
+	if err != nil || stored == nil {
 		return err
 	}
 
+	if stored.SessionToken != "" {
+		log.AddSecret(stored.SessionToken)
+		c.configuredSessionToken = c.sessionToken
+		c.sessionToken = stored.SessionToken
+	}
+
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+
+	if stored.AccessToken != "" && time.Now().Before(stored.ExpiresAt) {
+		c.accessToken = stored.AccessToken
+		c.accessTokenExpires = stored.ExpiresAt
+	}
+
+	return nil
+}
+
+func (c *ChatGPT) saveCredentials(creds *Credentials) {
+	if c.credentialStore == nil {
+		return
+	}
+
+	if err := c.credentialStore.Save(c.credentialAccount, &StoredCredentials{
+		SessionToken: c.sessionToken,
+		AccessToken:  creds.AccessToken,
+		ExpiresAt:    creds.ExpiresAt,
+	}); err != nil {
+		log.Warnf("Failed to save credentials: %v", err)
+	}
+}
+
+func (c *ChatGPT) refreshAccessTokenByPassword(ctx context.Context) (*Credentials, error) {
+	auth, err := NewAuthClientWithBrowser(c.email, c.password, c.proxy, c.browser, c.getUserAgent(), nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.SetEndpoints(c.authAddr, c.auth0Addr)
+
 	captcha, err := auth.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var answer string
 	if captcha.Available() {
-		if err := captcha.ToFile("captcha.png"); err != nil {
-			return err
-		}
-
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("Captcha answer: ")
-		answer, err = reader.ReadString('\n')
+		solveCtx, cancel := context.WithTimeout(ctx, c.captchaTimeout)
+		answer, err = c.captchaSolver.Solve(solveCtx, captcha)
+		cancel()
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("failed to solve captcha: %w", err)
 		}
-		answer = strings.Replace(answer, "\n", "", -1)
 	}
 
 	creds, err := auth.Finish(answer)
+	metrics.LoginAttempts.WithLabelValues(metrics.Result(err)).Inc()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c.accessToken = creds.AccessToken
-	c.accessTokenExpires = creds.ExpiresAt
+	if sessionToken := auth.SessionToken(); sessionToken != "" {
+		c.sessionToken = sessionToken
+	}
 
-	return nil
+	return creds, nil
 }
 
-func (c *ChatGPT) refreshAccessTokenBySessionToken(ctx context.Context) error {
-	url, _ := url.JoinPath(apiAddr, "auth", "session")
+func (c *ChatGPT) refreshAccessTokenBySessionToken(ctx context.Context) (*Credentials, error) {
+	url, _ := url.JoinPath(c.apiAddr, "auth", "session")
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if c.userAgent != "" {
-		req.Header.Set("User-Agent", c.userAgent)
-	} else {
-		req.Header.Set("User-Agent", userAgent)
-	}
-	req.AddCookie(&http.Cookie{
-		Name:  cookieSessionToken,
-		Value: c.sessionToken,
+	req.Header = c.newHeader(sessionHeaderOrder, http.Header{
+		"accept":          {"*/*"},
+		"sec-fetch-site":  {"same-origin"},
+		"sec-fetch-mode":  {"cors"},
+		"sec-fetch-dest":  {"empty"},
+		"referer":         {chatOrigin + "/chat"},
+		"accept-language": {"en-US,en;q=0.9"},
+		"cookie":          {c.cookies(&http.Cookie{Name: cookieSessionToken, Value: c.sessionToken})},
 	})
-	if c.cfClearance != "" {
-		req.AddCookie(&http.Cookie{
-			Name:  cookieCfClearance,
-			Value: c.cfClearance,
-		})
-	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	// The session token is rolled by the server from time to time
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == cookieSessionToken && cookie.Value != "" {
+			c.sessionToken = cookie.Value
+		}
 	}
 
 	var authResponse AuthSessionResponse
 	err = json.NewDecoder(resp.Body).Decode(&authResponse)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c.accessToken = authResponse.AccessToken
-	c.accessTokenExpires = authResponse.Expires
+	if authResponse.AccessToken == "" {
+		return nil, errors.New("session token is invalid or expired")
+	}
 
-	return nil
+	return &Credentials{
+		AccessToken: authResponse.AccessToken,
+		ExpiresAt:   authResponse.Expires,
+	}, nil
+}
+
+func (c *ChatGPT) getUserAgent() string {
+	if c.userAgent != "" {
+		return c.userAgent
+	}
+	return c.browser.UserAgent()
+}
+
+// newHeader adds the client hints and the user agent of the emulated
+// browser to header, ordered the way the browser sends them.
+func (c *ChatGPT) newHeader(order []string, header http.Header) http.Header {
+	header["sec-ch-ua"] = []string{c.m.ClientHintUA()}
+	header["sec-ch-ua-mobile"] = []string{"?0"}
+	header["sec-ch-ua-platform"] = []string{"\"Windows\""}
+	header["user-agent"] = []string{c.getUserAgent()}
+	header[http.HeaderOrderKey] = order
+	header[http.PHeaderOrderKey] = c.m.PseudoHeaderOrder()
+
+	if cookie, ok := header["cookie"]; ok && cookie[0] == "" {
+		delete(header, "cookie")
+	}
+
+	return header
+}
+
+// cookies formats the cookie header with cf_clearance and extra cookies.
+func (c *ChatGPT) cookies(extra ...*http.Cookie) string {
+	var cookies []string
+	for _, cookie := range extra {
+		cookies = append(cookies, cookie.String())
+	}
+	if c.cfClearance != "" {
+		cookies = append(cookies, (&http.Cookie{Name: cookieCfClearance, Value: c.cfClearance}).String())
+	}
+	return strings.Join(cookies, "; ")
 }
 
 type Conversation struct {
@@ -181,8 +476,18 @@ type Conversation struct {
 	ParentMessageId string
 }
 
+// ProgressHandler receives the answer received so far while it is streamed.
+type ProgressHandler func(partial string)
+
 func (c *Conversation) SendMessage(ctx context.Context, message string) (string, error) {
-	if err := c.ChatGPT.refreshAccessTokenIfExpired(ctx); err != nil {
+	return c.SendMessageStream(ctx, message, nil)
+}
+
+// SendMessageStream is SendMessage reporting the partial answer to progress
+// as every event arrives.
+func (c *Conversation) SendMessageStream(ctx context.Context, message string, progress ProgressHandler) (string, error) {
+	accessToken, err := c.ChatGPT.getAccessToken(ctx)
+	if err != nil {
 		return "", err
 	}
 
@@ -204,31 +509,31 @@ func (c *Conversation) SendMessage(ctx context.Context, message string) (string,
 	}
 
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(request)
+	err = json.NewEncoder(&buf).Encode(request)
 	if err != nil {
 		return "", err
 	}
 
-	url, _ := url.JoinPath(backendAPIAddr, "conversation")
+	url, _ := url.JoinPath(c.ChatGPT.backendAPIAddr, "conversation")
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
 	if err != nil {
 		return "", err
 	}
 
-	if c.ChatGPT.userAgent != "" {
-		req.Header.Set("User-Agent", c.ChatGPT.userAgent)
-	} else {
-		req.Header.Set("User-Agent", userAgent)
-	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.ChatGPT.accessToken))
-	req.Header.Set("Content-Type", "application/json")
-	if c.ChatGPT.cfClearance != "" {
-		req.AddCookie(&http.Cookie{
-			Name:  cookieCfClearance,
-			Value: c.ChatGPT.cfClearance,
-		})
-	}
+	req.Header = c.ChatGPT.newHeader(conversationHeaderOrder, http.Header{
+		"authorization":   {fmt.Sprintf("Bearer %s", accessToken)},
+		"content-type":    {"application/json"},
+		"accept":          {"text/event-stream"},
+		"origin":          {chatOrigin},
+		"sec-fetch-site":  {"same-origin"},
+		"sec-fetch-mode":  {"cors"},
+		"sec-fetch-dest":  {"empty"},
+		"referer":         {chatOrigin + "/chat"},
+		"accept-language": {"en-US,en;q=0.9"},
+		"cookie":          {c.ChatGPT.cookies()},
+	})
 
+	start := time.Now()
 	resp, err := c.ChatGPT.httpClient.Do(req)
 	if err != nil {
 		return "", err
@@ -237,11 +542,16 @@ func (c *Conversation) SendMessage(ctx context.Context, message string) (string,
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.ChatGPT.invalidateAccessToken(accessToken)
+		}
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+		return "", &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	respMessage := []byte{}
+	firstByte := true
+	done := false
 
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
@@ -252,28 +562,66 @@ func (c *Conversation) SendMessage(ctx context.Context, message string) (string,
 		}
 
 		if bytes.HasPrefix(line, []byte(dataPrefix)) {
+			if firstByte {
+				metrics.BackendFirstByte.Observe(time.Since(start).Seconds())
+				firstByte = false
+			}
+
 			data := bytes.TrimPrefix(line, []byte(dataPrefix))
 
 			if bytes.Equal(data, []byte(conversationEOF)) {
+				done = true
 				break
 			}
 
 			respMessage = make([]byte, len(data))
 			copy(respMessage, data)
+
+			if progress != nil {
+				var partial ConversationResponse
+				if err := json.Unmarshal(data, &partial); err == nil && len(partial.Message.Content.Parts) > 0 {
+					progress(partial.Message.Content.Parts[0])
+				}
+			}
 		}
 	}
+	metrics.BackendDuration.Observe(time.Since(start).Seconds())
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if !done {
+		return "", errors.New("conversation stream is truncated")
+	}
 
 	var cr ConversationResponse
 	if err := json.Unmarshal(respMessage, &cr); err != nil {
 		return "", err
 	}
 
+	if cr.Error != "" {
+		return "", fmt.Errorf("conversation error: %s", cr.Error)
+	}
+	if len(cr.Message.Content.Parts) == 0 {
+		return "", errors.New("conversation answer is empty")
+	}
+
 	c.ConversationId = cr.ConversationID
 	c.ParentMessageId = cr.Message.ID
 
 	return cr.Message.Content.Parts[0], nil
 }
 
+// StatusError is returned when ChatGPT answers with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
 type AuthSessionResponse struct {
 	Expires     time.Time `json:"expires"`
 	AccessToken string    `json:"accessToken"`
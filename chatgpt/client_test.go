@@ -0,0 +1,251 @@
+package chatgpt_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/duo/wechatgpt/chatgpt"
+	"github.com/duo/wechatgpt/chatgpt/chatgpttest"
+
+	fhttp "github.com/saucesteals/fhttp"
+)
+
+const testTimeout = 10 * time.Second
+
+func newFake(t *testing.T) *chatgpttest.Server {
+	fake := chatgpttest.NewServer()
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func newClient(fake *chatgpttest.Server, sessionToken string) *chatgpt.ChatGPT {
+	c := chatgpt.NewChatGPTWithClient("", "", sessionToken, "", "", &fhttp.Client{})
+	c.SetEndpoints(fake.APIAddr(), fake.BackendAPIAddr(), "", "")
+	return c
+}
+
+func send(t *testing.T, conversation *chatgpt.Conversation, message string) (string, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	return conversation.SendMessage(ctx, message)
+}
+
+func statusCode(err error) int {
+	var statusErr *chatgpt.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	return 0
+}
+
+func TestSendMessage(t *testing.T) {
+	fake := newFake(t)
+	conversation := newClient(fake, chatgpttest.SessionToken).NewConversation("")
+	parent := conversation.ParentMessageId
+
+	resp, err := send(t, conversation, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "echo: hello" {
+		t.Errorf("unexpected answer %q", resp)
+	}
+	if conversation.ConversationId == "" {
+		t.Error("conversation ID is not set")
+	}
+
+	answerID := conversation.ParentMessageId
+	if _, err := send(t, conversation, "again"); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := fake.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("expect 2 requests, got %d", len(requests))
+	}
+	if requests[0].ConversationID != "" || requests[0].ParentMessageID != parent {
+		t.Errorf("unexpected first request %+v", requests[0])
+	}
+	if requests[1].ConversationID != conversation.ConversationId || requests[1].ParentMessageID != answerID {
+		t.Errorf("second request does not continue the conversation: %+v", requests[1])
+	}
+}
+
+func TestSendMessageStream(t *testing.T) {
+	fake := newFake(t)
+	fake.Enqueue(chatgpttest.Reply{
+		Frames:     []string{"Hel", "Hello, wor", "Hello, world"},
+		FrameDelay: 10 * time.Millisecond,
+	})
+
+	var partials []string
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	resp, err := newClient(fake, chatgpttest.SessionToken).NewConversation("").SendMessageStream(ctx, "hi", func(partial string) {
+		partials = append(partials, partial)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "Hello, world" {
+		t.Errorf("unexpected answer %q", resp)
+	}
+	if strings.Join(partials, "|") != "Hel|Hello, wor|Hello, world" {
+		t.Errorf("unexpected progress %q", partials)
+	}
+}
+
+func TestConcurrentRequestsShareTokenRefresh(t *testing.T) {
+	fake := newFake(t)
+	c := newClient(fake, chatgpttest.SessionToken)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := send(t, c.NewConversation(""), "hi"); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if calls := fake.SessionCalls(); calls != 1 {
+		t.Errorf("expect 1 session call, got %d", calls)
+	}
+}
+
+func TestUnauthorizedRefreshesToken(t *testing.T) {
+	fake := newFake(t)
+	conversation := newClient(fake, chatgpttest.SessionToken).NewConversation("")
+
+	if _, err := send(t, conversation, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.ExpireTokens()
+	if _, err := send(t, conversation, "expired"); statusCode(err) != http.StatusUnauthorized {
+		t.Fatalf("expect 401, got %v", err)
+	}
+
+	if _, err := send(t, conversation, "refreshed"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fake.SessionCalls(); calls != 2 {
+		t.Errorf("expect 2 session calls, got %d", calls)
+	}
+
+	requests := fake.Requests()
+	if requests[2].AccessToken == requests[0].AccessToken {
+		t.Error("access token is not refreshed")
+	}
+}
+
+func TestInvalidSessionToken(t *testing.T) {
+	fake := newFake(t)
+
+	if _, err := send(t, newClient(fake, "invalid").NewConversation(""), "hello"); err == nil {
+		t.Fatal("expect an error")
+	}
+
+	fake.SetSessionStatus(http.StatusForbidden)
+	if _, err := send(t, newClient(fake, chatgpttest.SessionToken).NewConversation(""), "hello"); statusCode(err) != http.StatusForbidden {
+		t.Fatalf("expect 403, got %v", err)
+	}
+
+	if requests := fake.Requests(); len(requests) != 0 {
+		t.Errorf("expect no conversation request, got %d", len(requests))
+	}
+}
+
+func TestSendMessageErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  chatgpttest.Reply
+		status int
+		err    string
+	}{
+		{"rate limited", chatgpttest.Reply{Status: http.StatusTooManyRequests, Body: `{"detail":"Too many requests"}`}, http.StatusTooManyRequests, "Too many requests"},
+		{"server error", chatgpttest.Reply{Status: http.StatusInternalServerError}, http.StatusInternalServerError, ""},
+		{"truncated stream", chatgpttest.Reply{Truncate: true}, 0, "truncated"},
+		{"error event", chatgpttest.Reply{Error: "Something went wrong"}, 0, "Something went wrong"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFake(t)
+			fake.Enqueue(test.reply)
+			conversation := newClient(fake, chatgpttest.SessionToken).NewConversation("")
+
+			resp, err := send(t, conversation, "hello")
+			if err == nil {
+				t.Fatalf("expect an error, got %q", resp)
+			}
+			if statusCode(err) != test.status {
+				t.Errorf("expect status %d, got %v", test.status, err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expect error containing %q, got %v", test.err, err)
+			}
+			if conversation.ConversationId != "" {
+				t.Error("failed request changes the conversation")
+			}
+		})
+	}
+}
+
+func TestSendMessageTimeout(t *testing.T) {
+	fake := newFake(t)
+	fake.Enqueue(chatgpttest.Reply{Delay: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err := newClient(fake, chatgpttest.SessionToken).NewConversation("").SendMessage(ctx, "hello")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+}
+
+func TestStaleStoredSessionToken(t *testing.T) {
+	fake := newFake(t)
+	store := chatgpt.NewCredentialStore(filepath.Join(t.TempDir(), "credentials.json"), "")
+	if err := store.Save("a", &chatgpt.StoredCredentials{SessionToken: "stale"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(fake, chatgpttest.SessionToken)
+	if err := c.SetCredentialStore(store, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := send(t, c.NewConversation(""), "hello"); err != nil {
+		t.Fatalf("configured session token is not tried: %v", err)
+	}
+	if calls := fake.SessionCalls(); calls != 2 {
+		t.Errorf("expect 2 session calls, got %d", calls)
+	}
+
+	stored, err := store.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SessionToken != chatgpttest.SessionToken {
+		t.Errorf("working session token is not stored: %+v", stored)
+	}
+}
@@ -0,0 +1,147 @@
+package chatgpt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var encryptedMagic = []byte("WGPTENC1")
+
+// StoredCredentials is what survives a restart for an account.
+type StoredCredentials struct {
+	SessionToken string    `json:"session_token,omitempty"`
+	AccessToken  string    `json:"access_token,omitempty"`
+	ExpiresAt    time.Time `json:"expires,omitempty"`
+}
+
+// CredentialStore persists StoredCredentials of every account in one JSON
+// file, encrypted with AES-GCM when a secret is given.
+type CredentialStore struct {
+	path string
+	key  []byte
+
+	lock sync.Mutex
+}
+
+func NewCredentialStore(path, secret string) *CredentialStore {
+	store := &CredentialStore{path: path}
+	if secret != "" {
+		key := sha256.Sum256([]byte(secret))
+		store.key = key[:]
+	}
+	return store
+}
+
+func (s *CredentialStore) Load(account string) (*StoredCredentials, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	creds, ok := all[account]
+	if !ok {
+		return nil, nil
+	}
+	return creds, nil
+}
+
+func (s *CredentialStore) Save(account string, creds *StoredCredentials) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all, err := s.readAll()
+	if err != nil {
+		return err
+	}
+	all[account] = creds
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+
+	if s.key != nil {
+		if data, err = s.encrypt(data); err != nil {
+			return err
+		}
+	}
+
+	return WriteFileAtomic(s.path, data)
+}
+
+func (s *CredentialStore) readAll() (map[string]*StoredCredentials, error) {
+	all := make(map[string]*StoredCredentials)
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return all, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, encryptedMagic) {
+		if s.key == nil {
+			return nil, errors.New("credentials are encrypted but no secret is given")
+		}
+		if data, err = s.decrypt(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	return all, nil
+}
+
+func (s *CredentialStore) encrypt(plaintext []byte) ([]byte, error) {
+	gcm, err := s.newGCM()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	data := append([]byte{}, encryptedMagic...)
+	data = append(data, nonce...)
+	return gcm.Seal(data, nonce, plaintext, nil), nil
+}
+
+func (s *CredentialStore) decrypt(data []byte) ([]byte, error) {
+	gcm, err := s.newGCM()
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[len(encryptedMagic):]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("invalid encrypted credentials")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func (s *CredentialStore) newGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -128,4 +128,36 @@ var (
 		"sec-fetch-dest",
 		"accept-encoding",
 	}
+	sessionHeaderOrder = []string{
+		"sec-ch-ua",
+		"sec-ch-ua-mobile",
+		"user-agent",
+		"sec-ch-ua-platform",
+		"accept",
+		"sec-fetch-site",
+		"sec-fetch-mode",
+		"sec-fetch-dest",
+		"referer",
+		"accept-encoding",
+		"accept-language",
+		"cookie",
+	}
+	conversationHeaderOrder = []string{
+		"content-length",
+		"sec-ch-ua",
+		"accept",
+		"content-type",
+		"authorization",
+		"sec-ch-ua-mobile",
+		"user-agent",
+		"sec-ch-ua-platform",
+		"origin",
+		"sec-fetch-site",
+		"sec-fetch-mode",
+		"sec-fetch-dest",
+		"referer",
+		"accept-encoding",
+		"accept-language",
+		"cookie",
+	}
 )
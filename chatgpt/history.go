@@ -0,0 +1,95 @@
+package chatgpt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	http "github.com/saucesteals/fhttp"
+)
+
+// GetConversation returns the title and the latest message of a conversation.
+func (c *ChatGPT) GetConversation(ctx context.Context, id string) (*ConversationDetail, error) {
+	var detail ConversationDetail
+	if err := c.doBackend(ctx, http.MethodGet, "conversation/"+url.PathEscape(id), nil, &detail); err != nil {
+		return nil, err
+	}
+
+	return &detail, nil
+}
+
+// DeleteConversation hides a conversation the way the web UI deletes it.
+func (c *ChatGPT) DeleteConversation(ctx context.Context, id string) error {
+	visible := false
+	return c.doBackend(ctx, http.MethodPatch, "conversation/"+url.PathEscape(id), &ConversationPatch{IsVisible: &visible}, nil)
+}
+
+// doBackend sends a JSON request to the backend API and decodes the JSON
+// response into out if not nil.
+func (c *ChatGPT) doBackend(ctx context.Context, method, path string, in interface{}, out interface{}) error {
+	accessToken, err := c.getAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(in); err != nil {
+			return err
+		}
+		body = &buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.backendAPIAddr+"/"+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header = c.newHeader(conversationHeaderOrder, http.Header{
+		"authorization":   {fmt.Sprintf("Bearer %s", accessToken)},
+		"content-type":    {"application/json"},
+		"accept":          {"*/*"},
+		"origin":          {chatOrigin},
+		"sec-fetch-site":  {"same-origin"},
+		"sec-fetch-mode":  {"cors"},
+		"sec-fetch-dest":  {"empty"},
+		"referer":         {chatOrigin + "/chat"},
+		"accept-language": {"en-US,en;q=0.9"},
+		"cookie":          {c.cookies()},
+	})
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.invalidateAccessToken(accessToken)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type ConversationDetail struct {
+	Title       string  `json:"title"`
+	CreateTime  float64 `json:"create_time"`
+	CurrentNode string  `json:"current_node"`
+}
+
+type ConversationPatch struct {
+	IsVisible *bool `json:"is_visible,omitempty"`
+}
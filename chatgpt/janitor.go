@@ -0,0 +1,80 @@
+package chatgpt
+
+import (
+	"time"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const janitorInterval = time.Hour
+
+// StartJanitor periodically deletes the conversations created by the bot
+// which have not been active for maxAge from their accounts, until the task
+// manager is shut down. The first round runs after one interval.
+func (tm *TaskManager) StartJanitor(maxAge time.Duration) {
+	if tm.store == nil {
+		log.Warnf("Conversation janitor requires a conversation store")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				tm.prune(maxAge)
+			case <-tm.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (tm *TaskManager) prune(maxAge time.Duration) {
+	pruned := 0
+	inUse := tm.conversationsInUse()
+
+	for owner, records := range tm.store.Inactive(time.Now().Add(-maxAge)) {
+		for _, record := range records {
+			// Held by a worker or waiting to be restored
+			if inUse[record.ID] {
+				continue
+			}
+
+			client := tm.pool.Client(record.Account)
+			if client == nil {
+				// The account is gone, nothing can be deleted
+				tm.store.Remove(owner, record.ID)
+				continue
+			}
+			if err := tm.deleteConversation(client, owner, record.ID); err == nil {
+				pruned++
+			}
+		}
+	}
+
+	if pruned > 0 {
+		log.Infof("Pruned %d inactive conversations", pruned)
+	}
+}
+
+// conversationsInUse returns the IDs of the conversations of the workers
+// and of the restored state.
+func (tm *TaskManager) conversationsInUse() map[string]bool {
+	tm.taskQueueLock.Lock()
+	defer tm.taskQueueLock.Unlock()
+
+	inUse := make(map[string]bool, len(tm.workers)+len(tm.restored))
+	for _, w := range tm.workers {
+		if state, _ := w.state.Load().(ConversationState); state.ConversationId != "" {
+			inUse[state.ConversationId] = true
+		}
+	}
+	for _, state := range tm.restored {
+		inUse[state.ConversationId] = true
+	}
+
+	return inUse
+}
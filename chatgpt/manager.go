@@ -2,24 +2,56 @@ package chatgpt
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	http "github.com/saucesteals/fhttp"
+
+	"github.com/duo/wechatgpt/metrics"
+
+	log "github.com/duo/wechatgpt/logging"
 )
 
 const (
 	queueCapacity = 1024
 
-	cmdReset = "!reset"
+	cmdReset   = "!reset"
+	cmdQuota   = "!quota"
+	cmdHistory = "!history"
+	cmdResume  = "!resume"
+
+	historyLimit  = 10
+	deleteTimeout = 30 * time.Second
+	abortTimeout  = 5 * time.Second
+	waitInterval  = 50 * time.Millisecond
+	flushInterval = 10 * time.Second
+
+	defaultStatelessLimit = 4
 )
 
+// ErrShuttingDown is reported to tasks dropped while shutting down.
+var ErrShuttingDown = errors.New("the bot is shutting down, please send your message again later")
+
 type Task struct {
-	id      string
-	content string
-	timeout time.Duration
-	handler TaskHandler
+	id          string
+	user        string
+	group       string
+	content     string
+	attachments []string
+	timeout     time.Duration
+	handler     TaskHandler
+	progress    ProgressHandler
+	ctx         context.Context
+	stateless   bool
+
+	// quotaAt is when the quota of the task was taken, zero if it was not
+	quotaAt time.Time
 }
 
 type TaskHandler func(string, error)
@@ -27,64 +59,721 @@ type TaskHandler func(string, error)
 func NewTask(id string, content string, timeout time.Duration, handler TaskHandler) *Task {
 	return &Task{
 		id:      id,
+		user:    id,
 		content: content,
 		timeout: timeout,
 		handler: handler,
 	}
 }
 
+// NewTaskWithAttachments creates a task which first feeds every attachment
+// into the conversation, then sends content and reports its response.
+func NewTaskWithAttachments(id string, content string, attachments []string, timeout time.Duration, handler TaskHandler) *Task {
+	task := NewTask(id, content, timeout, handler)
+	task.attachments = attachments
+	return task
+}
+
+// WithOwner sets the user who sent the task and the group it was sent in
+// (empty for private chat), they are used for quota enforcement.
+func (t *Task) WithOwner(user, group string) *Task {
+	t.user = user
+	t.group = group
+	return t
+}
+
+// WithProgress reports the partial answer of the task to progress while it
+// is streamed.
+func (t *Task) WithProgress(progress ProgressHandler) *Task {
+	t.progress = progress
+	return t
+}
+
+// WithContext aborts the task when ctx is done.
+func (t *Task) WithContext(ctx context.Context) *Task {
+	t.ctx = ctx
+	return t
+}
+
+// Stateless runs the task in a new conversation which is dropped once
+// answered, its content is never handled as a command.
+func (t *Task) Stateless() *Task {
+	t.stateless = true
+	return t
+}
+
+type TaskStats struct {
+	Workers   int
+	Queued    int
+	Received  uint64
+	Completed uint64
+	Failed    uint64
+	StartedAt time.Time
+	Accounts  []AccountStats
+}
+
 type TaskManager struct {
-	client *ChatGPT
+	pool  *Pool
+	quota *QuotaManager
+	store *ConversationStore
+
+	resetDelete bool
+	contextTTL  time.Duration
 
 	taskQueue     map[string](chan *Task)
+	workers       map[string]*worker
+	restored      map[string]ConversationState
 	taskQueueLock sync.Mutex
+
+	// statelessSlots bounds the stateless tasks running at once
+	statelessSlots chan struct{}
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closed   atomic.Bool
+	inflight sync.WaitGroup
+	pending  atomic.Int64
+
+	resetGeneration atomic.Uint64
+	received        atomic.Uint64
+	completed       atomic.Uint64
+	failed          atomic.Uint64
+	startedAt       time.Time
+}
+
+// worker is the conversation state of a sender, only touched by the
+// goroutine serving the sender.
+type worker struct {
+	conversation *Conversation
+	generation   uint64
+	lastActive   time.Time
+
+	// state publishes the ConversationState of the worker to other
+	// goroutines, updated after every task
+	state atomic.Value
 }
 
-func NewTaskManager(email, password, sessionToken, userAgent, cfClearance string) *TaskManager {
+// publish snapshots the conversation state of w, from its goroutine.
+func (tm *TaskManager) publish(w *worker) {
+	w.state.Store(ConversationState{
+		Account:         tm.pool.Name(w.conversation.ChatGPT),
+		ConversationId:  w.conversation.ConversationId,
+		ParentMessageId: w.conversation.ParentMessageId,
+		LastActiveAt:    w.lastActive,
+	})
+}
+
+func NewTaskManager(pool *Pool) *TaskManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &TaskManager{
-		client:    NewChatGPT(email, password, sessionToken, userAgent, cfClearance),
+		pool:      pool,
 		taskQueue: make(map[string](chan *Task)),
+		workers:   make(map[string]*worker),
+		restored:  make(map[string]ConversationState),
+		ctx:       ctx,
+		cancel:    cancel,
+		startedAt: time.Now(),
+
+		statelessSlots: make(chan struct{}, defaultStatelessLimit),
+	}
+}
+
+// SetStatelessLimit sets how many stateless tasks run at once, the others
+// wait for their turn. It must be called before sending tasks.
+func (tm *TaskManager) SetStatelessLimit(limit int) {
+	tm.statelessSlots = make(chan struct{}, limit)
+}
+
+// SetQuotaConfig replaces the quota config if quota enforcement is enabled,
+// and reports whether it is.
+func (tm *TaskManager) SetQuotaConfig(config *QuotaConfig) bool {
+	if tm.quota == nil {
+		return false
+	}
+
+	tm.quota.SetConfig(config)
+	return true
+}
+
+// ResetAll makes every worker start a new conversation before its next task,
+// and drops the conversations restored for the senders silent so far.
+func (tm *TaskManager) ResetAll() {
+	tm.taskQueueLock.Lock()
+	restored := tm.restored
+	tm.restored = make(map[string]ConversationState)
+	tm.resetGeneration.Add(1)
+	tm.taskQueueLock.Unlock()
+
+	if !tm.resetDelete {
+		return
+	}
+	for owner, state := range restored {
+		if client := tm.pool.Client(state.Account); client != nil && state.ConversationId != "" {
+			tm.deleteConversation(client, owner, state.ConversationId)
+		}
+	}
+}
+
+func (tm *TaskManager) Stats() TaskStats {
+	tm.taskQueueLock.Lock()
+	defer tm.taskQueueLock.Unlock()
+
+	stats := TaskStats{
+		Workers:   len(tm.taskQueue),
+		Received:  tm.received.Load(),
+		Completed: tm.completed.Load(),
+		Failed:    tm.failed.Load(),
+		StartedAt: tm.startedAt,
+		Accounts:  tm.pool.Stats(),
+	}
+	for _, queue := range tm.taskQueue {
+		stats.Queued += len(queue)
+	}
+
+	return stats
+}
+
+func (tm *TaskManager) SetCaptchaSolver(solver CaptchaSolver, timeout time.Duration) {
+	for _, client := range tm.pool.Clients() {
+		client.SetCaptchaSolver(solver, timeout)
+	}
+}
+
+// SetConversationStore enables !history and !resume, which rely on the
+// conversations recorded in store. The store is saved periodically and on
+// shutdown.
+func (tm *TaskManager) SetConversationStore(store *ConversationStore) {
+	tm.store = store
+	if store != nil {
+		go tm.flushPeriodically("conversations", store.Flush)
+	}
+}
+
+// SetResetDelete makes resetting a conversation also delete it from the
+// ChatGPT account.
+func (tm *TaskManager) SetResetDelete(enabled bool) {
+	tm.resetDelete = enabled
+}
+
+// SetContextTTL makes a chat start a new conversation when its last message
+// is older than ttl, 0 keeps conversations forever.
+func (tm *TaskManager) SetContextTTL(ttl time.Duration) {
+	tm.contextTTL = ttl
+}
+
+// SetQuotaManager enables quota enforcement, nil disables it. The usage is
+// saved periodically and on shutdown.
+func (tm *TaskManager) SetQuotaManager(qm *QuotaManager) {
+	tm.quota = qm
+	if qm != nil {
+		go tm.flushPeriodically("quota usage", qm.Flush)
+	}
+}
+
+// flushPeriodically calls flush every flushInterval until the task manager
+// is shut down.
+func (tm *TaskManager) flushPeriodically(name string, flush func() error) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				log.Warnf("Failed to save %s: %v", name, err)
+			}
+		case <-tm.ctx.Done():
+			return
+		}
+	}
+}
+
+// flush saves what is still unsaved, once shut down.
+func (tm *TaskManager) flush() {
+	if tm.quota != nil {
+		if err := tm.quota.Flush(); err != nil {
+			log.Warnf("Failed to save quota usage: %v", err)
+		}
+	}
+	if tm.store != nil {
+		if err := tm.store.Flush(); err != nil {
+			log.Warnf("Failed to save conversations: %v", err)
+		}
 	}
 }
 
 func (tm *TaskManager) SendTask(task *Task) {
+	if !task.stateless && task.content == cmdQuota {
+		if tm.quota == nil {
+			task.handler(unlimitedReport(task.user, task.group), nil)
+		} else {
+			task.handler(tm.quota.Report(task.user, task.group), nil)
+		}
+		return
+	}
+
+	if err := tm.enqueue(task); err != nil {
+		task.handler("", err)
+	}
+}
+
+// enqueue hands task over to a worker, taking its quota first. The error
+// is not reported to the sender of task, for it to be done without holding
+// taskQueueLock.
+func (tm *TaskManager) enqueue(task *Task) error {
 	tm.taskQueueLock.Lock()
 	defer tm.taskQueueLock.Unlock()
 
+	if tm.closed.Load() {
+		return ErrShuttingDown
+	}
+
+	tm.received.Add(1)
+	metrics.TasksReceived.Inc()
+
+	if tm.quota != nil && (task.stateless || !isCommand(task.content)) {
+		at, err := tm.quota.Acquire(task.user, task.group)
+		if err != nil {
+			tm.failed.Add(1)
+			metrics.TasksFailed.WithLabelValues(errorType(err)).Inc()
+			return err
+		}
+		task.quotaAt = at
+	}
+
+	if task.stateless {
+		tm.inflight.Add(1)
+		tm.pending.Add(1)
+		go tm.processStateless(task)
+		return nil
+	}
+
 	queue, ok := tm.taskQueue[task.id]
 	if !ok {
 		queue = make(chan *Task, queueCapacity)
 		tm.taskQueue[task.id] = queue
+		metrics.Workers.Inc()
+
+		w := tm.newWorker(task.id)
+		tm.workers[task.id] = w
 
 		go func() {
-			defer func() {
-				panicErr := recover()
-				if panicErr != nil {
-					log.Warnf("Panic while process %+v: %v\n%s", task, panicErr, debug.Stack())
-				}
-			}()
+			for task := range queue {
+				tm.processSafely(w, task)
+			}
+		}()
+	}
 
-			conversation := tm.client.NewConversation("")
+	tm.inflight.Add(1)
+	tm.pending.Add(1)
+	metrics.QueueDepth.Inc()
+	metrics.QueueDepthBySender.WithLabelValues(metrics.SenderBucket(task.id)).Inc()
+	queue <- task
 
-			for task := range queue {
-				log.Debugf("Handle Task: %+v", task)
+	return nil
+}
+
+// fail reports err to the sender of task as its answer, giving back the
+// quota it took.
+func (tm *TaskManager) fail(task *Task, err error) {
+	tm.failed.Add(1)
+	metrics.TasksFailed.WithLabelValues(errorType(err)).Inc()
+	if !task.quotaAt.IsZero() {
+		tm.quota.Release(task.user, task.group, task.quotaAt)
+	}
+	task.handler("", err)
+}
+
+// newWorker restores the conversation owner had when the bot was shut down,
+// or starts a new one. The caller must hold taskQueueLock.
+func (tm *TaskManager) newWorker(owner string) *worker {
+	w := &worker{
+		generation: tm.resetGeneration.Load(),
+		lastActive: time.Now(),
+	}
+
+	if state, ok := tm.restored[owner]; ok {
+		delete(tm.restored, owner)
+		if client := tm.pool.Client(state.Account); client != nil {
+			w.conversation = tm.pool.Bind(client, state.ConversationId)
+			w.conversation.ParentMessageId = state.ParentMessageId
+			w.lastActive = state.LastActiveAt
+		}
+	}
+
+	if w.conversation == nil {
+		w.conversation = tm.pool.NewConversation()
+	}
+	tm.publish(w)
+
+	return w
+}
 
-				// Handle command
-				if task.content == cmdReset {
-					conversation = tm.client.NewConversation("")
-					task.handler("Reset conversation done.", nil)
-					continue
-				}
+// processSafely processes task, recovering from a panic so the worker goes
+// on with the next tasks of its queue.
+func (tm *TaskManager) processSafely(w *worker, task *Task) {
+	defer tm.inflight.Done()
+	defer tm.pending.Add(-1)
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			tm.failed.Add(1)
+			metrics.TasksFailed.WithLabelValues("panic").Inc()
+			log.Warnf("Panic while process %+v: %v\n%s", task, panicErr, debug.Stack())
+		}
+	}()
 
-				ctx, cancel := context.WithTimeout(context.Background(), task.timeout)
+	defer tm.publish(w)
 
-				resp, err := conversation.SendMessage(ctx, task.content)
-				task.handler(resp, err)
+	tm.process(w, task)
+}
+
+func (tm *TaskManager) process(w *worker, task *Task) {
+	log.Debugf("Handle Task: %+v", task)
+	metrics.QueueDepth.Dec()
+	metrics.QueueDepthBySender.WithLabelValues(metrics.SenderBucket(task.id)).Dec()
+
+	// Queued tasks are dropped once shutting down, only the running ones
+	// are waited for
+	if tm.closed.Load() {
+		tm.fail(task, ErrShuttingDown)
+		return
+	}
+
+	if current := tm.resetGeneration.Load(); current != w.generation {
+		w.conversation = tm.resetConversation(w.conversation, task.id)
+		w.generation = current
+	}
+
+	// Handle command
+	if isCommand(task.content) {
+		w.conversation = tm.handleCommand(w.conversation, task)
+		w.lastActive = time.Now()
+		return
+	}
+
+	metrics.ActiveWorkers.Inc()
+	defer metrics.ActiveWorkers.Dec()
+
+	expired := tm.contextTTL > 0 && w.conversation.ConversationId != "" && time.Since(w.lastActive) > tm.contextTTL
+	if expired {
+		log.Debugf("Conversation of %s expired", task.id)
+		w.conversation = tm.renewConversation(w.conversation)
+	}
+
+	// Conversations are bound to their account, fail over to a
+	// new one when the account is cooling down
+	if !tm.pool.Healthy(w.conversation) {
+		log.Infof("Fail over conversation of %s to another account", task.id)
+		w.conversation = tm.renewConversation(w.conversation)
+	}
+
+	if err := tm.sendAttachments(w.conversation, task); err != nil {
+		tm.fail(task, err)
+		return
+	}
+
+	resp, err := tm.sendMessage(w.conversation, task, task.content, task.progress)
+	if err != nil {
+		tm.fail(task, err)
+		return
+	}
+
+	tm.completed.Add(1)
+	metrics.TasksCompleted.Inc()
+	w.lastActive = time.Now()
+	if expired {
+		resp = "(new conversation started)\n\n" + resp
+	}
+	task.handler(resp, nil)
+}
+
+// processStateless answers task in a conversation of its own, once one of
+// the statelessSlots is free.
+func (tm *TaskManager) processStateless(task *Task) {
+	defer tm.inflight.Done()
+	defer tm.pending.Add(-1)
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			tm.failed.Add(1)
+			metrics.TasksFailed.WithLabelValues("panic").Inc()
+			log.Warnf("Panic while process %+v: %v\n%s", task, panicErr, debug.Stack())
+		}
+	}()
+
+	var done <-chan struct{}
+	if task.ctx != nil {
+		done = task.ctx.Done()
+	}
+	select {
+	case tm.statelessSlots <- struct{}{}:
+		defer func() { <-tm.statelessSlots }()
+	case <-done:
+		tm.fail(task, task.ctx.Err())
+		return
+	case <-tm.ctx.Done():
+	}
+
+	// Waiting tasks are dropped like queued ones once shutting down
+	if tm.closed.Load() {
+		tm.fail(task, ErrShuttingDown)
+		return
+	}
+
+	metrics.ActiveWorkers.Inc()
+	defer metrics.ActiveWorkers.Dec()
+
+	conversation := tm.pool.NewConversation()
+	defer tm.pool.Release(conversation)
+
+	resp, err := tm.sendMessage(conversation, task, task.content, task.progress)
+	if err != nil {
+		tm.fail(task, err)
+	} else {
+		tm.completed.Add(1)
+		metrics.TasksCompleted.Inc()
+		task.handler(resp, nil)
+	}
+
+	if tm.resetDelete && conversation.ConversationId != "" {
+		tm.deleteConversation(conversation.ChatGPT, task.id, conversation.ConversationId)
+	}
+}
+
+// Wait returns once no task is queued or running, or ctx is done. Unlike
+// Shutdown it keeps accepting tasks.
+func (tm *TaskManager) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+
+	for tm.pending.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Shutdown stops accepting tasks and drops the queued ones, telling their
+// senders. Running tasks are waited for until ctx is done, then aborted.
+func (tm *TaskManager) Shutdown(ctx context.Context) error {
+	tm.taskQueueLock.Lock()
+	tm.closed.Store(true)
+	tm.taskQueueLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		tm.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// Stops the janitor as well
+		tm.cancel()
+		tm.flush()
+		return nil
+	case <-ctx.Done():
+	}
+
+	tm.cancel()
+	select {
+	case <-done:
+	case <-time.After(abortTimeout):
+		log.Warnf("Tasks are still running after being aborted")
+	}
+	tm.flush()
+
+	return ctx.Err()
+}
+
+// errorType classifies err for the failed tasks metric.
+func errorType(err error) string {
+	var statusErr *StatusError
+	switch {
+	case errors.Is(err, ErrQuotaExceeded):
+		return "quota"
+	case errors.Is(err, ErrShuttingDown):
+		return "shutdown"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &statusErr):
+		switch statusErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return "unauthorized"
+		case http.StatusTooManyRequests:
+			return "rate_limited"
+		default:
+			return "status"
+		}
+	default:
+		return "other"
+	}
+}
+
+func (tm *TaskManager) sendAttachments(conversation *Conversation, task *Task) error {
+	for _, attachment := range task.attachments {
+		if _, err := tm.sendMessage(conversation, task, attachment, nil); err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+func (tm *TaskManager) sendMessage(conversation *Conversation, task *Task, message string, progress ProgressHandler) (string, error) {
+	ctx, cancel := context.WithTimeout(tm.ctx, task.timeout)
+	defer cancel()
+
+	if task.ctx != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-task.ctx.Done():
 				cancel()
+			case <-stop:
 			}
 		}()
 	}
 
-	queue <- task
+	resp, err := conversation.SendMessageStream(ctx, message, progress)
+	tm.pool.Report(conversation.ChatGPT, err)
+	if err == nil && tm.quota != nil {
+		tm.quota.AddTokens(task.user, task.group, EstimateTokens(message, resp))
+	}
+	// Stateless conversations are recorded too, for the janitor to prune
+	if err == nil && tm.store != nil && conversation.ConversationId != "" {
+		tm.store.Touch(task.id, tm.pool.Name(conversation.ChatGPT), conversation.ConversationId)
+	}
+
+	return resp, err
+}
+
+func (tm *TaskManager) renewConversation(conversation *Conversation) *Conversation {
+	tm.pool.Release(conversation)
+	return tm.pool.NewConversation()
+}
+
+// resetConversation starts a new conversation, deleting the previous one
+// from the account if enabled.
+func (tm *TaskManager) resetConversation(conversation *Conversation, owner string) *Conversation {
+	if tm.resetDelete && conversation.ConversationId != "" {
+		tm.deleteConversation(conversation.ChatGPT, owner, conversation.ConversationId)
+	}
+
+	return tm.renewConversation(conversation)
+}
+
+func (tm *TaskManager) deleteConversation(client *ChatGPT, owner, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+	defer cancel()
+
+	if err := client.DeleteConversation(ctx, id); err != nil {
+		log.Warnf("Failed to delete conversation %s: %v", id, err)
+		return err
+	}
+
+	if tm.store != nil {
+		tm.store.Remove(owner, id)
+	}
+
+	return nil
+}
+
+func isCommand(content string) bool {
+	return content == cmdReset || content == cmdHistory || content == cmdResume || strings.HasPrefix(content, cmdResume+" ")
+}
+
+// handleCommand runs a conversation command and returns the conversation
+// the worker continues with.
+func (tm *TaskManager) handleCommand(conversation *Conversation, task *Task) *Conversation {
+	switch {
+	case task.content == cmdReset:
+		conversation = tm.resetConversation(conversation, task.id)
+		task.handler("Reset conversation done.", nil)
+	case task.content == cmdHistory:
+		task.handler(tm.history(task))
+	default:
+		resumed, err := tm.resume(task)
+		if err != nil {
+			task.handler("", err)
+			break
+		}
+		tm.pool.Release(conversation)
+		conversation = resumed
+		task.handler("Resume conversation done.", nil)
+	}
+
+	return conversation
+}
+
+func (tm *TaskManager) history(task *Task) (string, error) {
+	if tm.store == nil {
+		return "", fmt.Errorf("conversation history is not enabled")
+	}
+
+	records := tm.store.List(task.id)
+	if len(records) == 0 {
+		return "No conversation yet.", nil
+	}
+	if len(records) > historyLimit {
+		records = records[:historyLimit]
+	}
+
+	ctx, cancel := context.WithTimeout(tm.ctx, task.timeout)
+	defer cancel()
+
+	var sb strings.Builder
+	for i, record := range records {
+		title := "(unavailable)"
+		if client := tm.pool.Client(record.Account); client != nil {
+			if detail, err := client.GetConversation(ctx, record.ID); err == nil {
+				title = detail.Title
+			} else {
+				log.Warnf("Failed to get conversation %s: %v", record.ID, err)
+			}
+		}
+		fmt.Fprintf(&sb, "%d. %s (%s)\n", i+1, title, record.LastActiveAt.Format("2006-01-02 15:04"))
+	}
+	sb.WriteString("\nSend \"!resume <n>\" to continue a conversation.")
+
+	return sb.String(), nil
+}
+
+func (tm *TaskManager) resume(task *Task) (*Conversation, error) {
+	if tm.store == nil {
+		return nil, fmt.Errorf("conversation history is not enabled")
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(task.content, cmdResume)))
+	records := tm.store.List(task.id)
+	if len(records) > historyLimit {
+		records = records[:historyLimit]
+	}
+	if err != nil || n < 1 || n > len(records) {
+		return nil, fmt.Errorf("usage: !resume <n>, n is a number listed by !history")
+	}
+	record := records[n-1]
+
+	client := tm.pool.Client(record.Account)
+	if client == nil {
+		return nil, fmt.Errorf("account %s of the conversation is not available", record.Account)
+	}
+
+	ctx, cancel := context.WithTimeout(tm.ctx, task.timeout)
+	defer cancel()
+
+	detail, err := client.GetConversation(ctx, record.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	conversation := tm.pool.Bind(client, record.ID)
+	conversation.ParentMessageId = detail.CurrentNode
+	tm.store.Touch(task.id, record.Account, record.ID)
+
+	return conversation, nil
 }
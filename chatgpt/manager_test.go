@@ -0,0 +1,502 @@
+package chatgpt_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duo/wechatgpt/chatgpt"
+	"github.com/duo/wechatgpt/chatgpt/chatgpttest"
+)
+
+type taskResult struct {
+	resp string
+	err  error
+}
+
+func newTaskManager(fake *chatgpttest.Server, accounts ...string) (*chatgpt.TaskManager, *chatgpt.Pool) {
+	pool := chatgpt.NewPool()
+	for _, name := range accounts {
+		pool.Add(name, newClient(fake, chatgpttest.SessionToken))
+	}
+	return chatgpt.NewTaskManager(pool), pool
+}
+
+// sendTask queues a task and returns where its result is delivered.
+func sendTask(tm *chatgpt.TaskManager, id, content string) <-chan taskResult {
+	results := make(chan taskResult, 1)
+	tm.SendTask(chatgpt.NewTask(id, content, testTimeout, func(resp string, err error) {
+		results <- taskResult{resp, err}
+	}))
+	return results
+}
+
+func wait(t *testing.T, results <-chan taskResult) taskResult {
+	t.Helper()
+
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(testTimeout):
+		t.Fatal("task is not done")
+		return taskResult{}
+	}
+}
+
+func waitRequests(t *testing.T, fake *chatgpttest.Server, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for len(fake.Requests()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d requests, got %d", n, len(fake.Requests()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTaskManagerKeepsConversation(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+
+	for _, content := range []string{"one", "two"} {
+		result := wait(t, sendTask(tm, "alice", content))
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		if result.resp != "echo: "+content {
+			t.Errorf("unexpected answer %q", result.resp)
+		}
+	}
+	if result := wait(t, sendTask(tm, "bob", "three")); result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	requests := fake.Requests()
+	if requests[1].ConversationID == "" || requests[1].ConversationID == requests[0].ConversationID {
+		t.Errorf("second task does not continue the conversation: %+v", requests[1])
+	}
+	if requests[2].ConversationID != "" {
+		t.Errorf("another sender shares the conversation: %+v", requests[2])
+	}
+
+	stats := tm.Stats()
+	if stats.Completed != 3 || stats.Workers != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTaskManagerReset(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+
+	if result := wait(t, sendTask(tm, "alice", "one")); result.err != nil {
+		t.Fatal(result.err)
+	}
+	if result := wait(t, sendTask(tm, "alice", "!reset")); result.err != nil {
+		t.Fatal(result.err)
+	}
+	if result := wait(t, sendTask(tm, "alice", "two")); result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	requests := fake.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("expect 2 requests, got %d", len(requests))
+	}
+	if requests[1].ConversationID != "" {
+		t.Errorf("reset does not start a new conversation: %+v", requests[1])
+	}
+}
+
+func TestTaskManagerStateless(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+
+	for _, content := range []string{"one", "!reset"} {
+		results := make(chan taskResult, 1)
+		tm.SendTask(chatgpt.NewTask("api", content, testTimeout, func(resp string, err error) {
+			results <- taskResult{resp, err}
+		}).Stateless())
+
+		result := wait(t, results)
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		if result.resp != "echo: "+content {
+			t.Errorf("unexpected answer %q", result.resp)
+		}
+	}
+
+	for _, request := range fake.Requests() {
+		if request.ConversationID != "" {
+			t.Errorf("stateless task continues a conversation: %+v", request)
+		}
+	}
+	if stats := tm.Stats(); stats.Workers != 0 {
+		t.Errorf("stateless tasks start workers: %+v", stats)
+	}
+}
+
+func TestTaskManagerTaskContext(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+
+	fake.Enqueue(chatgpttest.Reply{Delay: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan taskResult, 1)
+	tm.SendTask(chatgpt.NewTask("api", "one", testTimeout, func(resp string, err error) {
+		results <- taskResult{resp, err}
+	}).WithContext(ctx).Stateless())
+
+	waitRequests(t, fake, 1)
+	cancel()
+
+	if result := wait(t, results); !errors.Is(result.err, context.Canceled) {
+		t.Errorf("task is not aborted with its context: %v", result.err)
+	}
+}
+
+func TestTaskManagerFailover(t *testing.T) {
+	fake := newFake(t)
+	tm, pool := newTaskManager(fake, "a", "b")
+	pool.SetHealthPolicy(1, time.Minute)
+
+	fake.Enqueue(chatgpttest.Reply{Status: http.StatusTooManyRequests})
+
+	result := wait(t, sendTask(tm, "alice", "one"))
+	if statusCode(result.err) != http.StatusTooManyRequests {
+		t.Fatalf("expect 429, got %v", result.err)
+	}
+
+	result = wait(t, sendTask(tm, "alice", "two"))
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	requests := fake.Requests()
+	if requests[1].AccessToken == requests[0].AccessToken {
+		t.Error("conversation is not moved to another account")
+	}
+
+	for _, account := range tm.Stats().Accounts {
+		if account.Healthy != (account.Name == "b") {
+			t.Errorf("unexpected account stats %+v", account)
+		}
+	}
+}
+
+func TestTaskManagerShutdown(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+
+	fake.Enqueue(chatgpttest.Reply{Delay: 200 * time.Millisecond})
+
+	running := sendTask(tm, "alice", "one")
+	waitRequests(t, fake, 1)
+	queued := sendTask(tm, "alice", "two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := tm.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := wait(t, running); result.err != nil {
+		t.Errorf("running task is not waited for: %v", result.err)
+	}
+	if result := wait(t, queued); !errors.Is(result.err, chatgpt.ErrShuttingDown) {
+		t.Errorf("queued task is not dropped: %v", result.err)
+	}
+	if result := wait(t, sendTask(tm, "bob", "three")); !errors.Is(result.err, chatgpt.ErrShuttingDown) {
+		t.Errorf("task is accepted after shutdown: %v", result.err)
+	}
+}
+
+func TestTaskManagerShutdownAbort(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+
+	fake.Enqueue(chatgpttest.Reply{Delay: time.Minute})
+
+	running := sendTask(tm, "alice", "one")
+	waitRequests(t, fake, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := tm.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	if result := wait(t, running); !errors.Is(result.err, context.Canceled) {
+		t.Errorf("running task is not aborted: %v", result.err)
+	}
+}
+
+func TestTaskManagerStateKeepsSilentSenders(t *testing.T) {
+	fake := newFake(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	tm, _ := newTaskManager(fake, "a")
+	for _, id := range []string{"alice", "bob"} {
+		if result := wait(t, sendTask(tm, id, "hello")); result.err != nil {
+			t.Fatal(result.err)
+		}
+	}
+	if err := tm.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only alice writes after the first restart
+	for restart := 0; restart < 2; restart++ {
+		tm, _ = newTaskManager(fake, "a")
+		if err := tm.LoadState(path); err != nil {
+			t.Fatal(err)
+		}
+		if restart == 0 {
+			if result := wait(t, sendTask(tm, "alice", "again")); result.err != nil {
+				t.Fatal(result.err)
+			}
+		}
+		if err := tm.SaveState(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tm, _ = newTaskManager(fake, "a")
+	if err := tm.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if result := wait(t, sendTask(tm, "bob", "back")); result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	requests := fake.Requests()
+	if last := requests[len(requests)-1]; last.ConversationID == "" {
+		t.Errorf("conversation of a silent sender is lost: %+v", last)
+	}
+}
+
+func TestTaskManagerRecoversFromPanic(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+
+	tm.SendTask(chatgpt.NewTask("alice", "one", testTimeout, func(string, error) {
+		panic("handler failed")
+	}))
+	if result := wait(t, sendTask(tm, "alice", "two")); result.err != nil {
+		t.Fatalf("worker does not survive the panic: %v", result.err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tm.Shutdown(ctx); err != nil {
+		t.Errorf("panicked task is still waited for: %v", err)
+	}
+}
+
+func TestTaskManagerQuotaDisabled(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+
+	result := wait(t, sendTask(tm, "alice", "!quota"))
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if !strings.Contains(result.resp, "alice") || !strings.Contains(result.resp, "Unlimited") {
+		t.Errorf("unexpected report %q", result.resp)
+	}
+}
+
+func TestTaskManagerQuota(t *testing.T) {
+	fake := newFake(t)
+	path := filepath.Join(t.TempDir(), "quota.json")
+
+	tm, _ := newTaskManager(fake, "a")
+	qm, err := chatgpt.NewQuotaManager(&chatgpt.QuotaConfig{
+		Default: chatgpt.QuotaLimit{RequestsPerMinute: 1},
+	}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.SetQuotaManager(qm)
+
+	// Failed tasks give their quota back
+	fake.Enqueue(chatgpttest.Reply{Status: http.StatusInternalServerError})
+	if result := wait(t, sendTask(tm, "alice", "one")); statusCode(result.err) != http.StatusInternalServerError {
+		t.Fatalf("expect 500, got %v", result.err)
+	}
+	if result := wait(t, sendTask(tm, "alice", "two")); result.err != nil {
+		t.Fatalf("quota of the failed task is not given back: %v", result.err)
+	}
+	if result := wait(t, sendTask(tm, "alice", "three")); !errors.Is(result.err, chatgpt.ErrQuotaExceeded) {
+		t.Fatalf("expect quota exceeded, got %v", result.err)
+	}
+
+	// Groups are only limited when listed
+	for _, user := range []string{"bob", "carol"} {
+		results := make(chan taskResult, 1)
+		tm.SendTask(chatgpt.NewTask("room", "hello", testTimeout, func(resp string, err error) {
+			results <- taskResult{resp, err}
+		}).WithOwner(user, "room"))
+		if result := wait(t, results); result.err != nil {
+			t.Errorf("group is limited by default: %v", result.err)
+		}
+	}
+
+	if stats := tm.Stats(); stats.Failed != 2 || stats.Completed != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("usage is saved before shutdown: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := tm.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), "alice") {
+		t.Errorf("usage is not saved on shutdown: %q, %v", data, err)
+	}
+}
+
+func TestTaskManagerResetAllDropsRestored(t *testing.T) {
+	fake := newFake(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	tm, _ := newTaskManager(fake, "a")
+	if result := wait(t, sendTask(tm, "bob", "hello")); result.err != nil {
+		t.Fatal(result.err)
+	}
+	if err := tm.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm, _ = newTaskManager(fake, "a")
+	if err := tm.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	tm.ResetAll()
+
+	if result := wait(t, sendTask(tm, "bob", "back")); result.err != nil {
+		t.Fatal(result.err)
+	}
+	requests := fake.Requests()
+	if last := requests[len(requests)-1]; last.ConversationID != "" {
+		t.Errorf("restored conversation survives the reset: %+v", last)
+	}
+
+	if err := tm.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(data) == string(saved) {
+		t.Errorf("reset conversation is saved again: %s", data)
+	}
+}
+
+func TestTaskManagerSaveStateWhileRunning(t *testing.T) {
+	fake := newFake(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+	tm, _ := newTaskManager(fake, "a")
+
+	fake.Enqueue(chatgpttest.Reply{FrameDelay: 10 * time.Millisecond})
+	results := sendTask(tm, "alice", "hello")
+
+	// Run with -race, saving must not read what the worker writes
+	for {
+		if err := tm.SaveState(path); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case result := <-results:
+			if result.err != nil {
+				t.Fatal(result.err)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestTaskManagerStatelessLimit(t *testing.T) {
+	fake := newFake(t)
+	tm, _ := newTaskManager(fake, "a")
+	tm.SetStatelessLimit(1)
+
+	store, err := chatgpt.NewConversationStore(filepath.Join(t.TempDir(), "conversations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.SetConversationStore(store)
+
+	fake.Enqueue(chatgpttest.Reply{Delay: 200 * time.Millisecond})
+
+	results := make(chan taskResult, 2)
+	for _, content := range []string{"one", "two"} {
+		tm.SendTask(chatgpt.NewTask("api", content, testTimeout, func(resp string, err error) {
+			results <- taskResult{resp, err}
+		}).Stateless())
+	}
+
+	waitRequests(t, fake, 1)
+	time.Sleep(100 * time.Millisecond)
+	if n := len(fake.Requests()); n != 1 {
+		t.Errorf("expect 1 running task, got %d", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if result := wait(t, results); result.err != nil {
+			t.Fatal(result.err)
+		}
+	}
+	if records := store.List("api"); len(records) != 2 {
+		t.Errorf("stateless conversations are not recorded: %+v", records)
+	}
+}
+
+func TestTaskManagerFlushesStoreOnShutdown(t *testing.T) {
+	fake := newFake(t)
+	path := filepath.Join(t.TempDir(), "conversations.json")
+
+	tm, _ := newTaskManager(fake, "a")
+	store, err := chatgpt.NewConversationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.SetConversationStore(store)
+
+	if result := wait(t, sendTask(tm, "alice", "hello")); result.err != nil {
+		t.Fatal(result.err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("conversations are saved on every message: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := tm.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := chatgpt.NewConversationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := reloaded.List("alice"); len(records) != 1 {
+		t.Errorf("conversations are not saved on shutdown: %+v", records)
+	}
+}
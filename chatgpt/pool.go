@@ -0,0 +1,284 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	http "github.com/saucesteals/fhttp"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	defaultMaxFailures = 3
+	defaultCooldown    = 10 * time.Minute
+)
+
+// Account is the login information of one ChatGPT account.
+type Account struct {
+	Name         string  `json:"name"`
+	Email        string  `json:"email"`
+	Password     string  `json:"password"`
+	SessionToken string  `json:"session_token"`
+	UserAgent    string  `json:"user_agent"`
+	CfClearance  string  `json:"cf_clearance"`
+	Proxy        string  `json:"proxy"`
+	Browser      Browser `json:"browser"`
+
+	APIAddr        string `json:"api_addr"`
+	BackendAPIAddr string `json:"backend_api_addr"`
+	AuthAddr       string `json:"auth_addr"`
+	Auth0Addr      string `json:"auth0_addr"`
+}
+
+func LoadAccounts(path string) ([]Account, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, err
+	}
+
+	if len(accounts) == 0 {
+		return nil, errors.New("no account found")
+	}
+
+	return accounts, nil
+}
+
+type AccountStats struct {
+	Name           string
+	Conversations  int
+	Failures       int
+	Healthy        bool
+	UnhealthyUntil time.Time
+	TokenExpires   time.Time
+	LastSuccess    time.Time
+}
+
+type poolAccount struct {
+	name           string
+	client         *ChatGPT
+	conversations  int
+	failures       int
+	lastSuccess    time.Time
+	unhealthyUntil time.Time
+}
+
+func (a *poolAccount) healthy(now time.Time) bool {
+	return !now.Before(a.unhealthyUntil)
+}
+
+// Pool spreads conversations over several ChatGPT accounts by load, and
+// takes accounts out of rotation for a cool-down after repeated 401/429.
+type Pool struct {
+	accounts    []*poolAccount
+	maxFailures int
+	cooldown    time.Duration
+
+	lock sync.Mutex
+}
+
+func NewPool() *Pool {
+	return &Pool{
+		maxFailures: defaultMaxFailures,
+		cooldown:    defaultCooldown,
+	}
+}
+
+func (p *Pool) Add(name string, client *ChatGPT) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.accounts = append(p.accounts, &poolAccount{name: name, client: client})
+}
+
+// SetHealthPolicy changes how many consecutive failures make an account
+// unhealthy and how long it stays out of rotation.
+func (p *Pool) SetHealthPolicy(maxFailures int, cooldown time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.maxFailures = maxFailures
+	p.cooldown = cooldown
+}
+
+func (p *Pool) Clients() []*ChatGPT {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	clients := make([]*ChatGPT, len(p.accounts))
+	for i, account := range p.accounts {
+		clients[i] = account.client
+	}
+	return clients
+}
+
+// NewConversation starts a conversation on the healthy account with the
+// fewest conversations. When every account is cooling down the one which
+// recovers first is used.
+func (p *Pool) NewConversation() *Conversation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	var best *poolAccount
+	for _, account := range p.accounts {
+		if best == nil {
+			best = account
+			continue
+		}
+
+		accountHealthy, bestHealthy := account.healthy(now), best.healthy(now)
+		switch {
+		case accountHealthy && !bestHealthy:
+			best = account
+		case accountHealthy && bestHealthy && account.conversations < best.conversations:
+			best = account
+		case !accountHealthy && !bestHealthy && account.unhealthyUntil.Before(best.unhealthyUntil):
+			best = account
+		}
+	}
+
+	best.conversations++
+
+	return best.client.NewConversation("")
+}
+
+// Bind resumes an existing conversation of client, taking a slot on its
+// account.
+func (p *Pool) Bind(client *ChatGPT, conversationId string) *Conversation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if account := p.find(client); account != nil {
+		account.conversations++
+	}
+
+	return client.NewConversation(conversationId)
+}
+
+// Name returns the account name of client.
+func (p *Pool) Name(client *ChatGPT) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if account := p.find(client); account != nil {
+		return account.name
+	}
+	return ""
+}
+
+// Client returns the client of the named account, or nil.
+func (p *Pool) Client(name string) *ChatGPT {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, account := range p.accounts {
+		if account.name == name {
+			return account.client
+		}
+	}
+	return nil
+}
+
+// Release gives back the slot taken by a conversation which is replaced.
+func (p *Pool) Release(conversation *Conversation) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if account := p.find(conversation.ChatGPT); account != nil && account.conversations > 0 {
+		account.conversations--
+	}
+}
+
+// Healthy reports whether the account of the conversation is usable, or
+// whether no other account would be better.
+func (p *Pool) Healthy(conversation *Conversation) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	account := p.find(conversation.ChatGPT)
+	if account == nil || account.healthy(now) {
+		return true
+	}
+
+	for _, other := range p.accounts {
+		if other.healthy(now) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Report records the result of a request sent by client.
+func (p *Pool) Report(client *ChatGPT, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	account := p.find(client)
+	if account == nil {
+		return
+	}
+
+	if err == nil {
+		account.failures = 0
+		account.lastSuccess = time.Now()
+		return
+	}
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return
+	}
+	if statusErr.StatusCode != http.StatusUnauthorized && statusErr.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+
+	account.failures++
+	if account.failures >= p.maxFailures {
+		account.unhealthyUntil = time.Now().Add(p.cooldown)
+		account.failures = 0
+		log.Warnf("Account %s is unhealthy until %v: %v", account.name, account.unhealthyUntil, err)
+	}
+}
+
+func (p *Pool) Stats() []AccountStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	stats := make([]AccountStats, len(p.accounts))
+	for i, account := range p.accounts {
+		stats[i] = AccountStats{
+			Name:           account.name,
+			Conversations:  account.conversations,
+			Failures:       account.failures,
+			Healthy:        account.healthy(now),
+			UnhealthyUntil: account.unhealthyUntil,
+			TokenExpires:   account.client.TokenExpires(),
+			LastSuccess:    account.lastSuccess,
+		}
+	}
+	return stats
+}
+
+func (p *Pool) find(client *ChatGPT) *poolAccount {
+	for _, account := range p.accounts {
+		if account.client == client {
+			return account
+		}
+	}
+	return nil
+}
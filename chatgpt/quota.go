@@ -0,0 +1,334 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	dayLayout = "2006-01-02"
+
+	userKeyPrefix  = "user:"
+	groupKeyPrefix = "group:"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaLimit limits the usage of a user or group, zero means unlimited.
+type QuotaLimit struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+	RequestsPerDay    int `json:"requests_per_day"`
+	TokensPerDay      int `json:"tokens_per_day"`
+}
+
+func (l QuotaLimit) unlimited() bool {
+	return l.RequestsPerMinute <= 0 && l.RequestsPerDay <= 0 && l.TokensPerDay <= 0
+}
+
+// QuotaConfig holds the default limit of every contact and the per-contact
+// and per-group limits, keyed by the stable contact or group ID. A contact
+// limit replaces the default limit as a whole, groups are unlimited unless
+// listed.
+type QuotaConfig struct {
+	Default QuotaLimit            `json:"default"`
+	Users   map[string]QuotaLimit `json:"users"`
+	Groups  map[string]QuotaLimit `json:"groups"`
+}
+
+func LoadQuotaConfig(path string) (*QuotaConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config QuotaConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+type quotaUsage struct {
+	Minute         time.Time `json:"minute"`
+	MinuteRequests int       `json:"minute_requests"`
+	Day            string    `json:"day"`
+	DayRequests    int       `json:"day_requests"`
+	DayTokens      int       `json:"day_tokens"`
+}
+
+func (u *quotaUsage) rotate(now time.Time) {
+	if minute := now.Truncate(time.Minute); !u.Minute.Equal(minute) {
+		u.Minute = minute
+		u.MinuteRequests = 0
+	}
+	if day := now.Format(dayLayout); u.Day != day {
+		u.Day = day
+		u.DayRequests = 0
+		u.DayTokens = 0
+	}
+}
+
+func (u *quotaUsage) release(at time.Time) {
+	if u.Minute.Equal(at.Truncate(time.Minute)) && u.MinuteRequests > 0 {
+		u.MinuteRequests--
+	}
+	if u.Day == at.Format(dayLayout) && u.DayRequests > 0 {
+		u.DayRequests--
+	}
+}
+
+func (u *quotaUsage) check(limit QuotaLimit) error {
+	if limit.RequestsPerMinute > 0 && u.MinuteRequests >= limit.RequestsPerMinute {
+		return fmt.Errorf("%w: %d requests per minute", ErrQuotaExceeded, limit.RequestsPerMinute)
+	}
+	if limit.RequestsPerDay > 0 && u.DayRequests >= limit.RequestsPerDay {
+		return fmt.Errorf("%w: %d requests per day", ErrQuotaExceeded, limit.RequestsPerDay)
+	}
+	if limit.TokensPerDay > 0 && u.DayTokens >= limit.TokensPerDay {
+		return fmt.Errorf("%w: %d tokens per day", ErrQuotaExceeded, limit.TokensPerDay)
+	}
+	return nil
+}
+
+// QuotaManager enforces QuotaConfig and persists the usage to a JSON file so
+// it survives restarts.
+type QuotaManager struct {
+	config *QuotaConfig
+	path   string
+
+	usage     map[string]*quotaUsage
+	dirty     bool
+	usageLock sync.Mutex
+	saveLock  sync.Mutex
+}
+
+func NewQuotaManager(config *QuotaConfig, path string) (*QuotaManager, error) {
+	qm := &QuotaManager{
+		config: config,
+		path:   path,
+		usage:  make(map[string]*quotaUsage),
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &qm.usage); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return qm, nil
+}
+
+func (qm *QuotaManager) SetConfig(config *QuotaConfig) {
+	qm.usageLock.Lock()
+	defer qm.usageLock.Unlock()
+
+	qm.config = config
+}
+
+func (qm *QuotaManager) userLimit(user string) QuotaLimit {
+	if limit, ok := qm.config.Users[user]; ok {
+		return limit
+	}
+	return qm.config.Default
+}
+
+func (qm *QuotaManager) groupLimit(group string) QuotaLimit {
+	return qm.config.Groups[group]
+}
+
+func (qm *QuotaManager) getUsage(key string, now time.Time) *quotaUsage {
+	usage, ok := qm.usage[key]
+	if !ok {
+		usage = &quotaUsage{}
+		qm.usage[key] = usage
+	}
+	usage.rotate(now)
+	return usage
+}
+
+// Acquire checks the quotas of user and group (if any) and records one
+// request when both allow it, returning when it was recorded.
+func (qm *QuotaManager) Acquire(user, group string) (time.Time, error) {
+	qm.usageLock.Lock()
+	defer qm.usageLock.Unlock()
+
+	now := time.Now()
+
+	userLimit := qm.userLimit(user)
+	userUsage := qm.getUsage(userKeyPrefix+user, now)
+	if err := userUsage.check(userLimit); err != nil {
+		return time.Time{}, err
+	}
+
+	var groupUsage *quotaUsage
+	if group != "" {
+		groupLimit := qm.groupLimit(group)
+		groupUsage = qm.getUsage(groupKeyPrefix+group, now)
+		if err := groupUsage.check(groupLimit); err != nil {
+			return time.Time{}, fmt.Errorf("group %w", err)
+		}
+	}
+
+	userUsage.MinuteRequests++
+	userUsage.DayRequests++
+	if groupUsage != nil {
+		groupUsage.MinuteRequests++
+		groupUsage.DayRequests++
+	}
+	qm.dirty = true
+
+	return now, nil
+}
+
+// Release gives back the request Acquire recorded at, for a request which
+// failed. Windows which ended since are left alone.
+func (qm *QuotaManager) Release(user, group string, at time.Time) {
+	qm.usageLock.Lock()
+	defer qm.usageLock.Unlock()
+
+	now := time.Now()
+
+	qm.getUsage(userKeyPrefix+user, now).release(at)
+	if group != "" {
+		qm.getUsage(groupKeyPrefix+group, now).release(at)
+	}
+	qm.dirty = true
+}
+
+// AddTokens records the tokens consumed by a completed request.
+func (qm *QuotaManager) AddTokens(user, group string, tokens int) {
+	qm.usageLock.Lock()
+	defer qm.usageLock.Unlock()
+
+	now := time.Now()
+
+	qm.getUsage(userKeyPrefix+user, now).DayTokens += tokens
+	if group != "" {
+		qm.getUsage(groupKeyPrefix+group, now).DayTokens += tokens
+	}
+	qm.dirty = true
+}
+
+// Report describes the remaining quota of user and group.
+func (qm *QuotaManager) Report(user, group string) string {
+	qm.usageLock.Lock()
+	defer qm.usageLock.Unlock()
+
+	now := time.Now()
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Your ID: %s\n", user)
+	writeQuotaReport(&sb, qm.userLimit(user), qm.getUsage(userKeyPrefix+user, now))
+	if group != "" {
+		fmt.Fprintf(&sb, "\nGroup ID: %s\n", group)
+		writeQuotaReport(&sb, qm.groupLimit(group), qm.getUsage(groupKeyPrefix+group, now))
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+// unlimitedReport is the Report of user and group without quota enforcement.
+func unlimitedReport(user, group string) string {
+	report := fmt.Sprintf("Your ID: %s\nUnlimited", user)
+	if group != "" {
+		report += fmt.Sprintf("\n\nGroup ID: %s\nUnlimited", group)
+	}
+	return report
+}
+
+func writeQuotaReport(sb *strings.Builder, limit QuotaLimit, usage *quotaUsage) {
+	if limit.unlimited() {
+		sb.WriteString("Unlimited\n")
+		return
+	}
+
+	if limit.RequestsPerMinute > 0 {
+		fmt.Fprintf(sb, "Requests this minute: %d/%d\n", usage.MinuteRequests, limit.RequestsPerMinute)
+	}
+	if limit.RequestsPerDay > 0 {
+		fmt.Fprintf(sb, "Requests today: %d/%d\n", usage.DayRequests, limit.RequestsPerDay)
+	}
+	if limit.TokensPerDay > 0 {
+		fmt.Fprintf(sb, "Tokens today: %d/%d\n", usage.DayTokens, limit.TokensPerDay)
+	}
+}
+
+// Flush drops the usage of past days and writes the rest to the file if it
+// changed since the last flush.
+func (qm *QuotaManager) Flush() error {
+	qm.saveLock.Lock()
+	defer qm.saveLock.Unlock()
+
+	qm.usageLock.Lock()
+	if !qm.dirty || qm.path == "" {
+		qm.usageLock.Unlock()
+		return nil
+	}
+
+	today := time.Now().Format(dayLayout)
+	for key, usage := range qm.usage {
+		if usage.Day != today {
+			delete(qm.usage, key)
+		}
+	}
+
+	data, err := json.Marshal(qm.usage)
+	qm.dirty = false
+	qm.usageLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(qm.path, data)
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it to path,
+// so a crash never leaves a truncated file behind.
+func WriteFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// EstimateTokens roughly counts tokens the way the OpenAI tokenizer does:
+// about four latin characters per token and one token per CJK character.
+func EstimateTokens(texts ...string) int {
+	latin := 0
+	tokens := 0
+	for _, text := range texts {
+		for _, r := range text {
+			if r > unicode.MaxASCII {
+				tokens++
+			} else {
+				latin++
+			}
+		}
+	}
+	return tokens + (latin+3)/4
+}
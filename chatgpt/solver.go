@@ -0,0 +1,213 @@
+package chatgpt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	captchaFile = "captcha.png"
+)
+
+var ErrCaptchaPending = errors.New("another captcha is pending")
+
+// CaptchaSolver returns the answer of a captcha challenge, it must give up
+// when ctx is done.
+type CaptchaSolver interface {
+	Solve(ctx context.Context, captcha Captcha) (string, error)
+}
+
+// StdinCaptchaSolver writes the captcha to captcha.png and reads the answer
+// from stdin.
+type StdinCaptchaSolver struct {
+	once  sync.Once
+	lines chan string
+}
+
+func NewStdinCaptchaSolver() *StdinCaptchaSolver {
+	return &StdinCaptchaSolver{
+		lines: make(chan string),
+	}
+}
+
+func (s *StdinCaptchaSolver) Solve(ctx context.Context, captcha Captcha) (string, error) {
+	if err := captcha.ToFile(captchaFile); err != nil {
+		return "", err
+	}
+
+	// A single reader outlives Solve, so a timed out call never leaves a
+	// goroutine blocked on stdin which steals the next answer.
+	s.once.Do(func() {
+		go func() {
+			reader := bufio.NewReader(os.Stdin)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					close(s.lines)
+					return
+				}
+				s.lines <- strings.TrimSpace(line)
+			}
+		}()
+	})
+
+	fmt.Printf("Captcha saved to %s\nCaptcha answer: ", captchaFile)
+
+	select {
+	case answer, ok := <-s.lines:
+		if !ok {
+			return "", io.EOF
+		}
+		return answer, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// AsyncCaptchaSolver publishes the pending captcha through a callback and
+// waits for an answer delivered by Answer, it is the building block of
+// solvers whose answer arrives from elsewhere (a chat message, a web form).
+type AsyncCaptchaSolver struct {
+	notify func(ctx context.Context, png []byte) error
+
+	lock    sync.Mutex
+	png     []byte
+	answers chan string
+}
+
+// NewAsyncCaptchaSolver creates a solver, notify may be nil when the
+// captcha is only pulled through Pending.
+func NewAsyncCaptchaSolver(notify func(ctx context.Context, png []byte) error) *AsyncCaptchaSolver {
+	return &AsyncCaptchaSolver{
+		notify: notify,
+	}
+}
+
+func (s *AsyncCaptchaSolver) Solve(ctx context.Context, captcha Captcha) (string, error) {
+	png, err := captcha.ToPng()
+	if err != nil {
+		return "", err
+	}
+
+	answers := make(chan string, 1)
+
+	s.lock.Lock()
+	if s.answers != nil {
+		s.lock.Unlock()
+		return "", ErrCaptchaPending
+	}
+	s.png = png
+	s.answers = answers
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.png = nil
+		s.answers = nil
+		s.lock.Unlock()
+	}()
+
+	if s.notify != nil {
+		if err := s.notify(ctx, png); err != nil {
+			return "", err
+		}
+	}
+
+	select {
+	case answer := <-answers:
+		return answer, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Pending returns the PNG of the captcha waiting for an answer, or nil.
+func (s *AsyncCaptchaSolver) Pending() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.png
+}
+
+// Answer delivers the answer of the pending captcha, it reports false if
+// there is no captcha waiting.
+func (s *AsyncCaptchaSolver) Answer(answer string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.answers == nil {
+		return false
+	}
+
+	select {
+	case s.answers <- strings.TrimSpace(answer):
+	default:
+	}
+
+	return true
+}
+
+var captchaPage = template.Must(template.New("captcha").Parse(`<!DOCTYPE html>
+<html>
+<head><title>ChatGPT captcha</title></head>
+<body>
+{{if .}}
+<img src="?image=1" alt="captcha">
+<form method="post">
+<input name="answer" autofocus>
+<button type="submit">Submit</button>
+</form>
+{{else}}
+<p>No pending captcha.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// HTTPCaptchaSolver serves the pending captcha on a web page and takes the
+// answer from its form.
+type HTTPCaptchaSolver struct {
+	*AsyncCaptchaSolver
+}
+
+func NewHTTPCaptchaSolver() *HTTPCaptchaSolver {
+	return &HTTPCaptchaSolver{
+		AsyncCaptchaSolver: NewAsyncCaptchaSolver(nil),
+	}
+}
+
+func (s *HTTPCaptchaSolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		png := s.Pending()
+		if r.URL.Query().Get("image") != "" {
+			if png == nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write(png)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		captchaPage.Execute(w, png != nil)
+	case http.MethodPost:
+		if !s.Answer(r.FormValue("answer")) {
+			http.Error(w, "No pending captcha", http.StatusConflict)
+			return
+		}
+		w.Write([]byte("Answer submitted."))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,66 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// ConversationState is the conversation a sender is in, saved on shutdown
+// to be continued after restart.
+type ConversationState struct {
+	Account         string    `json:"account"`
+	ConversationId  string    `json:"conversation_id"`
+	ParentMessageId string    `json:"parent_message_id"`
+	LastActiveAt    time.Time `json:"last_active_at"`
+}
+
+// SaveState writes the conversation of every sender to path, as of their
+// last finished task. Senders silent since the last restart keep the
+// conversation restored for them.
+func (tm *TaskManager) SaveState(path string) error {
+	tm.taskQueueLock.Lock()
+	defer tm.taskQueueLock.Unlock()
+
+	states := make(map[string]ConversationState, len(tm.restored)+len(tm.workers))
+	for owner, state := range tm.restored {
+		states[owner] = state
+	}
+	// Workers still running after an aborted shutdown own their
+	// conversation, only their snapshot is safe to read
+	for owner, w := range tm.workers {
+		if state, _ := w.state.Load().(ConversationState); state.ConversationId != "" {
+			states[owner] = state
+		}
+	}
+
+	data, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, data)
+}
+
+// LoadState restores the conversations saved by SaveState, each sender
+// continues its conversation with its next task.
+func (tm *TaskManager) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	states := make(map[string]ConversationState)
+	if err := json.Unmarshal(data, &states); err != nil {
+		return err
+	}
+
+	tm.taskQueueLock.Lock()
+	defer tm.taskQueueLock.Unlock()
+
+	tm.restored = states
+
+	return nil
+}
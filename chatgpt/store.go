@@ -0,0 +1,147 @@
+package chatgpt
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConversationRecord is a conversation created by the bot for a chat.
+type ConversationRecord struct {
+	ID           string    `json:"id"`
+	Account      string    `json:"account"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActiveAt time.Time `json:"last_active_at"`
+}
+
+// ConversationStore remembers the conversations of every chat, persisted to
+// a JSON file by Flush when a path is given.
+type ConversationStore struct {
+	path string
+
+	records  map[string][]*ConversationRecord
+	dirty    bool
+	lock     sync.Mutex
+	saveLock sync.Mutex
+}
+
+func NewConversationStore(path string) (*ConversationStore, error) {
+	store := &ConversationStore{
+		path:    path,
+		records: make(map[string][]*ConversationRecord),
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &store.records); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return store, nil
+}
+
+// Touch records activity of conversation id of owner, adding it if unknown.
+func (s *ConversationStore) Touch(owner, account, id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+
+	for _, record := range s.records[owner] {
+		if record.ID == id {
+			record.LastActiveAt = now
+			s.dirty = true
+			return
+		}
+	}
+
+	s.records[owner] = append(s.records[owner], &ConversationRecord{
+		ID:           id,
+		Account:      account,
+		CreatedAt:    now,
+		LastActiveAt: now,
+	})
+	s.dirty = true
+}
+
+// List returns the conversations of owner, most recently active first.
+func (s *ConversationStore) List(owner string) []ConversationRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records := make([]ConversationRecord, len(s.records[owner]))
+	for i, record := range s.records[owner] {
+		records[i] = *record
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].LastActiveAt.After(records[j].LastActiveAt)
+	})
+
+	return records
+}
+
+// Remove forgets conversation id of owner.
+func (s *ConversationStore) Remove(owner, id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records := s.records[owner]
+	for i, record := range records {
+		if record.ID == id {
+			s.records[owner] = append(records[:i], records[i+1:]...)
+			if len(s.records[owner]) == 0 {
+				delete(s.records, owner)
+			}
+			s.dirty = true
+			return
+		}
+	}
+}
+
+// Inactive returns the conversations of every owner not active since before.
+func (s *ConversationStore) Inactive(before time.Time) map[string][]ConversationRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	inactive := make(map[string][]ConversationRecord)
+	for owner, records := range s.records {
+		for _, record := range records {
+			if record.LastActiveAt.Before(before) {
+				inactive[owner] = append(inactive[owner], *record)
+			}
+		}
+	}
+
+	return inactive
+}
+
+// Flush writes the conversations to the file if they changed since the
+// last flush.
+func (s *ConversationStore) Flush() error {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+
+	s.lock.Lock()
+	if !s.dirty || s.path == "" {
+		s.lock.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(s.records)
+	s.dirty = false
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.path, data)
+}
@@ -0,0 +1,104 @@
+package document
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported document format")
+	ErrTooLarge          = errors.New("the document is too large once decompressed")
+)
+
+// MaxDecompressedSize caps how much the compressed parts of a document may
+// inflate to, guarding against decompression bombs.
+var MaxDecompressedSize int64 = 64 << 20
+
+// Extract returns the plain text of a document, the format is detected by
+// the file extension of name.
+func Extract(name string, data []byte) (string, error) {
+	var (
+		text string
+		err  error
+	)
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt", ".md", ".markdown", ".csv", ".log":
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("%s is not valid UTF-8 text", name)
+		}
+		text = string(data)
+	case ".pdf":
+		text, err = extractPDF(data)
+	case ".docx":
+		text, err = extractDOCX(data)
+	default:
+		return "", ErrUnsupportedFormat
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", fmt.Errorf("no text found in %s", name)
+	}
+
+	return text, nil
+}
+
+// IsSupported reports whether Extract knows how to handle name.
+func IsSupported(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt", ".md", ".markdown", ".csv", ".log", ".pdf", ".docx":
+		return true
+	default:
+		return false
+	}
+}
+
+// Chunk splits text into pieces of at most size runes, preferring to break
+// at paragraph and line boundaries.
+func Chunk(text string, size int) []string {
+	if size <= 0 {
+		return []string{text}
+	}
+
+	var chunks []string
+	var current strings.Builder
+	currentLen := 0
+
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			chunks = append(chunks, s)
+		}
+		current.Reset()
+		currentLen = 0
+	}
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lineLen := utf8.RuneCountInString(line)
+
+		if currentLen+lineLen > size {
+			flush()
+		}
+
+		// Hard split lines which are longer than a whole chunk
+		for lineLen > size {
+			runes := []rune(line)
+			chunks = append(chunks, string(runes[:size]))
+			line = string(runes[size:])
+			lineLen -= size
+		}
+
+		current.WriteString(line)
+		currentLen += lineLen
+	}
+	flush()
+
+	return chunks
+}
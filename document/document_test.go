@@ -0,0 +1,125 @@
+package document
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"latin.pdf", "Hello, world.\nSecond line\n\nCafé on page two."},
+		{"chinese.pdf", "你好，世界\n中文文档测试"},
+		{"array-contents.pdf", "First stream\nSecond stream"},
+		{"report.docx", "Quarterly report\nRevenue:\t42\n第一行\n第二行"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := Extract(test.name, readFixture(t, test.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if normalize(text) != normalize(test.want) {
+				t.Errorf("unexpected text %q", text)
+			}
+		})
+	}
+}
+
+func TestExtractUndecodable(t *testing.T) {
+	_, err := Extract("cid.pdf", readFixture(t, "cid-without-tounicode.pdf"))
+	if !errors.Is(err, ErrUndecodableText) {
+		t.Fatalf("expect undecodable text, got %v", err)
+	}
+}
+
+func TestExtractDecompressionBomb(t *testing.T) {
+	defer func(size int64) { MaxDecompressedSize = size }(MaxDecompressedSize)
+	MaxDecompressedSize = 1 << 20
+
+	bomb := bytes.Repeat([]byte("0 0 m "), 1<<20)
+
+	t.Run("pdf", func(t *testing.T) {
+		var body bytes.Buffer
+		w := zlib.NewWriter(&body)
+		w.Write(bomb)
+		w.Close()
+
+		var data bytes.Buffer
+		fmt.Fprintf(&data, "%%PDF-1.7\n1 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", body.Len())
+		data.Write(body.Bytes())
+		data.WriteString("\nendstream\nendobj\n")
+
+		if _, err := Extract("bomb.pdf", data.Bytes()); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("expect too large, got %v", err)
+		}
+	})
+
+	t.Run("docx", func(t *testing.T) {
+		var data bytes.Buffer
+		z := zip.NewWriter(&data)
+		f, _ := z.Create("word/document.xml")
+		f.Write([]byte("<w:document><w:body><w:p><w:r><w:t>"))
+		f.Write(bomb)
+		f.Write([]byte("</w:t></w:r></w:p></w:body></w:document>"))
+		z.Close()
+
+		if _, err := Extract("bomb.docx", data.Bytes()); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("expect too large, got %v", err)
+		}
+	})
+}
+
+func TestExtractText(t *testing.T) {
+	if _, err := Extract("notes.txt", []byte{0xff, 0xfe}); err == nil {
+		t.Error("expect invalid UTF-8 to fail")
+	}
+	if _, err := Extract("notes.xls", []byte("x")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expect unsupported format, got %v", err)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	text := "第一段\n\n" + strings.Repeat("长", 12) + "\nend"
+	chunks := Chunk(text, 5)
+
+	for _, chunk := range chunks {
+		if n := len([]rune(chunk)); n > 5 {
+			t.Errorf("chunk %q has %d runes", chunk, n)
+		}
+	}
+	if strings.Join(chunks, "") != strings.NewReplacer("\n", "").Replace(text) {
+		t.Errorf("chunks lose text: %q", chunks)
+	}
+}
+
+// normalize ignores the spacing differences of the extractors.
+func normalize(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
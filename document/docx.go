@@ -0,0 +1,89 @@
+package document
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+const docxDocumentPath = "word/document.xml"
+
+func extractDOCX(data []byte) (string, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	for _, f := range reader.File {
+		if f.Name != docxDocumentPath {
+			continue
+		}
+
+		if f.UncompressedSize64 > uint64(MaxDecompressedSize) {
+			return "", ErrTooLarge
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		// The declared size may lie, the reader is capped as well
+		lr := &io.LimitedReader{R: rc, N: MaxDecompressedSize + 1}
+		text, err := parseDocumentXML(lr)
+		if lr.N <= 0 {
+			return "", ErrTooLarge
+		}
+		return text, err
+	}
+
+	return "", errors.New("invalid docx: word/document.xml not found")
+}
+
+// parseDocumentXML collects the w:t runs of a WordprocessingML body,
+// keeping paragraph, tab and line breaks.
+func parseDocumentXML(r io.Reader) (string, error) {
+	var sb strings.Builder
+
+	decoder := xml.NewDecoder(r)
+	inText := false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				sb.WriteString("\t")
+			case "br", "cr":
+				sb.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				sb.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				sb.Write(t)
+			}
+		}
+	}
+
+	return sb.String(), nil
+}
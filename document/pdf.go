@@ -0,0 +1,241 @@
+package document
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+)
+
+var (
+	pdfHeader      = []byte("%PDF-")
+	pdfStream      = []byte("stream")
+	pdfEndStream   = []byte("endstream")
+	pdfFlateDecode = []byte("/FlateDecode")
+)
+
+// ErrUndecodableText is returned for documents whose text can not be turned
+// into Unicode, such as CID fonts without a ToUnicode map.
+var ErrUndecodableText = errors.New("the text of the document can not be decoded")
+
+// undecodableRatio is the share of control and replacement characters above
+// which the extracted text is considered garbage.
+const undecodableRatio = 0.1
+
+// extractPDF collects the text shown on every page, the fonts are decoded
+// through their encoding or ToUnicode map.
+func extractPDF(data []byte) (text string, err error) {
+	if !bytes.HasPrefix(data, pdfHeader) {
+		return "", errors.New("invalid pdf: missing header")
+	}
+
+	// The parser inflates streams on demand, check their size up front
+	if err := checkPDFStreams(data); err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			text = ""
+			if e, ok := r.(error); ok && errors.Is(e, ErrTooLarge) {
+				err = ErrTooLarge
+			} else {
+				err = fmt.Errorf("invalid pdf: %v", r)
+			}
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("invalid pdf: %w", err)
+	}
+
+	w := &limitedWriter{limit: MaxDecompressedSize}
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+
+		fonts := make(map[string]pdf.TextEncoding)
+		for _, name := range page.Fonts() {
+			font := page.Font(name)
+			// Composite fonts show glyph IDs, which mean nothing without
+			// a ToUnicode map
+			if font.V.Key("Subtype").Name() == "Type0" && font.V.Key("ToUnicode").Kind() != pdf.Stream {
+				return "", ErrUndecodableText
+			}
+			fonts[name] = font.Encoder()
+		}
+
+		showPDFPage(page, fonts, w)
+		w.WriteString("\n")
+	}
+
+	text = w.String()
+	if undecodable(text) {
+		return "", ErrUndecodableText
+	}
+
+	return text, nil
+}
+
+// showPDFPage writes the strings shown by the text operators of page,
+// breaking lines where the text moves to a new one.
+func showPDFPage(page pdf.Page, fonts map[string]pdf.TextEncoding, w *limitedWriter) {
+	var enc pdf.TextEncoding
+
+	show := func(s string) {
+		if enc == nil {
+			w.WriteString(s)
+		} else {
+			w.WriteString(enc.Decode(s))
+		}
+	}
+
+	interpret := func(stk *pdf.Stack, op string) {
+		args := make([]pdf.Value, stk.Len())
+		for i := len(args) - 1; i >= 0; i-- {
+			args[i] = stk.Pop()
+		}
+
+		switch op {
+		case "Tf":
+			if len(args) == 2 {
+				enc = fonts[args[0].Name()]
+			}
+		case "Tj":
+			if len(args) == 1 {
+				show(args[0].RawString())
+			}
+		case "'", "\"":
+			w.WriteString("\n")
+			if len(args) > 0 {
+				show(args[len(args)-1].RawString())
+			}
+		case "TJ":
+			if len(args) != 1 {
+				return
+			}
+			for i := 0; i < args[0].Len(); i++ {
+				x := args[0].Index(i)
+				switch x.Kind() {
+				case pdf.String:
+					show(x.RawString())
+				case pdf.Integer, pdf.Real:
+					// Large negative kerning separates words
+					if x.Float64() < -200 {
+						w.WriteString(" ")
+					}
+				}
+			}
+		case "T*", "ET":
+			w.WriteString("\n")
+		case "Td", "TD":
+			if len(args) == 2 && args[1].Float64() != 0 {
+				w.WriteString("\n")
+			} else {
+				w.WriteString(" ")
+			}
+		}
+	}
+
+	// Contents is either a stream or an array of streams
+	contents := page.V.Key("Contents")
+	if contents.Kind() != pdf.Array {
+		pdf.Interpret(contents, interpret)
+		return
+	}
+	for i := 0; i < contents.Len(); i++ {
+		pdf.Interpret(contents.Index(i), interpret)
+	}
+}
+
+// checkPDFStreams fails if the Flate streams of data inflate to more than
+// MaxDecompressedSize in total.
+func checkPDFStreams(data []byte) error {
+	var total int64
+
+	pos := 0
+	for {
+		idx := bytes.Index(data[pos:], pdfStream)
+		if idx < 0 {
+			return nil
+		}
+		start := pos + idx
+
+		// Skip the tail of "endstream"
+		if start >= 3 && bytes.Equal(data[start-3:start], []byte("end")) {
+			pos = start + len(pdfStream)
+			continue
+		}
+
+		dict := data[pos:start]
+		bodyStart := start + len(pdfStream)
+		if bodyStart < len(data) && data[bodyStart] == '\r' {
+			bodyStart++
+		}
+		if bodyStart < len(data) && data[bodyStart] == '\n' {
+			bodyStart++
+		}
+
+		end := bytes.Index(data[bodyStart:], pdfEndStream)
+		if end < 0 {
+			return nil
+		}
+		body := data[bodyStart : bodyStart+end]
+		pos = bodyStart + end + len(pdfEndStream)
+
+		if !bytes.Contains(dict, pdfFlateDecode) {
+			continue
+		}
+
+		reader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		n, _ := io.Copy(io.Discard, io.LimitReader(reader, MaxDecompressedSize-total+1))
+		reader.Close()
+
+		total += n
+		if total > MaxDecompressedSize {
+			return ErrTooLarge
+		}
+	}
+}
+
+// undecodable reports whether text is mostly made of characters which are
+// never shown, the sign of a font encoding which was not understood.
+func undecodable(text string) bool {
+	total, bad := 0, 0
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		total++
+		if r == utf8.RuneError || unicode.IsControl(r) || unicode.Is(unicode.Co, r) {
+			bad++
+		}
+	}
+	return total > 0 && float64(bad) > float64(total)*undecodableRatio
+}
+
+// limitedWriter collects text and panics with ErrTooLarge past limit, to
+// abort the interpreter which can not return errors.
+type limitedWriter struct {
+	strings.Builder
+	limit int64
+}
+
+func (w *limitedWriter) WriteString(s string) (int, error) {
+	if int64(w.Len()+len(s)) > w.limit {
+		panic(ErrTooLarge)
+	}
+	return w.Builder.WriteString(s)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/duo/wechatgpt/imagegen"
+	"github.com/duo/wechatgpt/messaging"
+	"github.com/duo/wechatgpt/metrics"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	cmdDraw = "!draw"
+
+	defaultDrawLimit  = 5
+	defaultDrawWindow = time.Hour
+	drawAbortTimeout  = 5 * time.Second
+)
+
+var (
+	drawGenerator imagegen.Generator
+	drawLimiter   *imagegen.RateLimiter
+
+	// drawing tracks the images being generated, for shutdown to wait for
+	drawing             sync.WaitGroup
+	drawClosed          bool
+	drawLock            sync.Mutex
+	drawCtx, drawCancel = context.WithCancel(context.Background())
+)
+
+func initDraw() {
+	provider := strings.ToLower(os.Getenv("DRAW_PROVIDER"))
+	size := os.Getenv("DRAW_SIZE")
+
+	switch provider {
+	case "":
+		return
+	case imagegen.ProviderOpenAI:
+		apiKey := os.Getenv("OPENAI_API_KEY")
+		if apiKey == "" {
+			log.Fatal("OPENAI_API_KEY is required by DRAW_PROVIDER=openai")
+		}
+		log.AddSecret(apiKey)
+		generator, err := imagegen.NewOpenAIGenerator(os.Getenv("OPENAI_API_ADDR"), apiKey, size)
+		if err != nil {
+			log.Fatal(err)
+		}
+		drawGenerator = generator
+	case imagegen.ProviderStableDiffusion:
+		generator, err := imagegen.NewStableDiffusionGenerator(os.Getenv("SD_API_ADDR"), size)
+		if err != nil {
+			log.Fatal(err)
+		}
+		drawGenerator = generator
+	default:
+		log.Fatalf("Unknown DRAW_PROVIDER: %s", provider)
+	}
+
+	limit := getEnvInt("DRAW_LIMIT", defaultDrawLimit)
+
+	window := defaultDrawWindow
+	if value := os.Getenv("DRAW_WINDOW"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		window = duration
+	}
+
+	drawLimiter = imagegen.NewRateLimiter(limit, window)
+}
+
+func isDrawCommand(content string) bool {
+	return content == cmdDraw || strings.HasPrefix(content, cmdDraw+" ")
+}
+
+func handleDraw(msg *messaging.Message, userID string, responsePrefix string, content string) {
+	if drawGenerator == nil {
+		replyText(msg, responsePrefix+"[ERROR] Image generation is not enabled")
+		return
+	}
+
+	prompt := strings.TrimSpace(strings.TrimPrefix(content, cmdDraw))
+	if prompt == "" {
+		replyText(msg, responsePrefix+"Usage: !draw <prompt>")
+		return
+	}
+
+	ok, wait, event := drawLimiter.Allow(userID)
+	if !ok {
+		replyText(msg, fmt.Sprintf("%sDraw rate limit exceeded, try again in %v", responsePrefix, wait.Round(time.Second)))
+		return
+	}
+
+	drawLock.Lock()
+	defer drawLock.Unlock()
+	if drawClosed {
+		drawLimiter.Refund(userID, event)
+		return
+	}
+	drawing.Add(1)
+
+	go func() {
+		defer drawing.Done()
+
+		ctx, cancel := context.WithTimeout(drawCtx, getTaskTimeout())
+		defer cancel()
+
+		image, err := drawGenerator.Generate(ctx, prompt)
+		if err != nil {
+			// Failures do not count towards the limit
+			drawLimiter.Refund(userID, event)
+			log.Warnf("Failed to generate image: %v", err)
+			replyText(msg, fmt.Sprintf("%s[ERROR] Failed to generate image\n\n%v", responsePrefix, err))
+			return
+		}
+
+		if err := msg.ReplyImage(image); err != nil {
+			metrics.ReplyFailures.WithLabelValues(msg.Adapter.Name()).Inc()
+			log.Warnf("Failed to reply image: %v", err)
+		}
+	}()
+}
+
+// waitDraws stops accepting draw commands and waits for the images being
+// generated until ctx is done, then aborts them.
+func waitDraws(ctx context.Context) error {
+	drawLock.Lock()
+	drawClosed = true
+	drawLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		drawing.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		drawCancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	drawCancel()
+	select {
+	case <-done:
+	case <-time.After(drawAbortTimeout):
+		log.Warnf("Draws are still running after being aborted")
+	}
+
+	return ctx.Err()
+}
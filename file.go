@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/duo/wechatgpt/chatgpt"
+	"github.com/duo/wechatgpt/document"
+	"github.com/duo/wechatgpt/messaging"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	fileModeSummarize = "summarize"
+	fileModeAttach    = "attach"
+
+	defaultFileChunkSize = 3000
+	defaultFileMaxChunks = 10
+	defaultFileMaxSize   = 10 * 1024 * 1024
+
+	attachmentPrompt = "Here is part %d/%d of the document \"%s\". Only reply \"OK\", I will ask questions after all parts are sent.\n\n%s"
+	summarizePrompt  = "All parts of the document \"%s\" are sent. Summarize it."
+	attachPrompt     = "All parts of the document \"%s\" are sent. Describe it in one sentence, then wait for my questions."
+)
+
+var (
+	fileMode      string
+	fileChunkSize int
+	fileMaxChunks int
+	fileMaxSize   int64
+)
+
+func initFile() {
+	fileMode = strings.ToLower(os.Getenv("FILE_MODE"))
+	switch fileMode {
+	case "":
+		fileMode = fileModeSummarize
+	case fileModeSummarize, fileModeAttach:
+	default:
+		log.Fatalf("Unknown FILE_MODE: %s", fileMode)
+	}
+
+	fileChunkSize = getEnvInt("FILE_CHUNK_SIZE", defaultFileChunkSize)
+	fileMaxChunks = getEnvInt("FILE_MAX_CHUNKS", defaultFileMaxChunks)
+	fileMaxSize = int64(getEnvInt("FILE_MAX_SIZE", defaultFileMaxSize))
+}
+
+func handleFile(msg *messaging.Message, taskManager *chatgpt.TaskManager) {
+	name := msg.File.Name
+	if !document.IsSupported(name) {
+		log.Debugf("Skip unsupported file: %s", name)
+		return
+	}
+
+	if size := msg.File.Size; size > fileMaxSize {
+		replyText(msg, fmt.Sprintf("[ERROR] File is too large (%d > %d bytes)", size, fileMaxSize))
+		return
+	}
+
+	// The size is not always known before download
+	data, err := msg.File.Download(fileMaxSize)
+	if errors.Is(err, messaging.ErrFileTooLarge) {
+		replyText(msg, fmt.Sprintf("[ERROR] File is too large (> %d bytes)", fileMaxSize))
+		return
+	}
+	if err != nil {
+		log.Warnf("Failed to download file %s: %v", name, err)
+		replyText(msg, fmt.Sprintf("[ERROR] Failed to download file\n\n%v", err))
+		return
+	}
+
+	text, err := document.Extract(name, data)
+	if err != nil {
+		log.Warnf("Failed to extract text from %s: %v", name, err)
+		replyText(msg, fmt.Sprintf("[ERROR] Failed to read file\n\n%v", err))
+		return
+	}
+
+	chunks := document.Chunk(text, fileChunkSize)
+	if len(chunks) > fileMaxChunks {
+		replyText(msg, fmt.Sprintf("[ERROR] File is too long (%d parts > %d)", len(chunks), fileMaxChunks))
+		return
+	}
+
+	attachments := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		attachments[i] = fmt.Sprintf(attachmentPrompt, i+1, len(chunks), name, chunk)
+	}
+
+	prompt := fmt.Sprintf(summarizePrompt, name)
+	if fileMode == fileModeAttach {
+		prompt = fmt.Sprintf(attachPrompt, name)
+	}
+
+	taskManager.SendTask(chatgpt.NewTaskWithAttachments(
+		msg.ChatID,
+		prompt,
+		attachments,
+		getTaskTimeout(),
+		func(resp string, err error) {
+			if err != nil {
+				log.Warnf("Failed to process file %s: %v", name, err)
+				replyText(msg, fmt.Sprintf("[ERROR] Failed to process file\n\n%v", err))
+			} else {
+				replyText(msg, resp)
+			}
+		},
+	).WithOwner(msg.Sender.ID, ""))
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return n
+}
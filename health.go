@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/duo/wechatgpt/chatgpt"
+	"github.com/duo/wechatgpt/messaging"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const defaultReadyMaxQueue = 100
+
+type healthReport struct {
+	Ready       bool            `json:"ready"`
+	Reasons     []string        `json:"reasons,omitempty"`
+	Adapters    map[string]bool `json:"adapters"`
+	Accounts    []accountHealth `json:"accounts"`
+	LastSuccess *time.Time      `json:"last_success,omitempty"`
+	Queued      int             `json:"queued"`
+	Workers     int             `json:"workers"`
+}
+
+type accountHealth struct {
+	Name         string     `json:"name"`
+	Healthy      bool       `json:"healthy"`
+	TokenValid   bool       `json:"token_valid"`
+	TokenExpires *time.Time `json:"token_expires,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+}
+
+// initHealth registers /healthz, which answers as long as the process is
+// serving, and /readyz, which fails unless the bot can answer messages.
+// Both report the same details.
+func initHealth(adapters []messaging.Adapter, taskManager *chatgpt.TaskManager) {
+	maxQueue := defaultReadyMaxQueue
+	if value := os.Getenv("READY_MAX_QUEUE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid READY_MAX_QUEUE: %s", value)
+		}
+		maxQueue = n
+	}
+
+	httpMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, checkHealth(adapters, taskManager, maxQueue), http.StatusOK)
+	})
+
+	httpMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := checkHealth(adapters, taskManager, maxQueue)
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, report, status)
+	})
+}
+
+func checkHealth(adapters []messaging.Adapter, taskManager *chatgpt.TaskManager, maxQueue int) *healthReport {
+	stats := taskManager.Stats()
+	now := time.Now()
+
+	report := &healthReport{
+		Adapters: make(map[string]bool, len(adapters)),
+		Accounts: make([]accountHealth, len(stats.Accounts)),
+		Queued:   stats.Queued,
+		Workers:  stats.Workers,
+	}
+
+	healthy := false
+	for i, account := range stats.Accounts {
+		report.Accounts[i] = accountHealth{
+			Name:         account.Name,
+			Healthy:      account.Healthy,
+			TokenValid:   now.Before(account.TokenExpires),
+			TokenExpires: optionalTime(account.TokenExpires),
+			LastSuccess:  optionalTime(account.LastSuccess),
+		}
+		if account.Healthy {
+			healthy = true
+		}
+		if report.LastSuccess == nil || account.LastSuccess.After(*report.LastSuccess) {
+			report.LastSuccess = optionalTime(account.LastSuccess)
+		}
+	}
+
+	for _, adapter := range adapters {
+		alive := adapter.Alive()
+		report.Adapters[adapter.Name()] = alive
+		if !alive {
+			report.Reasons = append(report.Reasons, adapter.Name()+" is not logged in")
+		}
+	}
+	if !healthy {
+		report.Reasons = append(report.Reasons, "no healthy ChatGPT account")
+	}
+	if report.Queued > maxQueue {
+		report.Reasons = append(report.Reasons, "too many queued tasks")
+	}
+	report.Ready = len(report.Reasons) == 0
+
+	return report
+}
+
+func writeHealth(w http.ResponseWriter, report *healthReport, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Warnf("Failed to write health report: %v", err)
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
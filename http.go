@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+// adminTokenCookie keeps the HTTP_ADMIN_TOKEN given in the URL, for the
+// images and forms of the admin pages.
+const adminTokenCookie = "wechatgpt_admin_token"
+
+var httpMux = http.NewServeMux()
+
+// startHTTPServer serves every handler registered on httpMux when HTTP_ADDR
+// is set.
+func startHTTPServer() {
+	addr := os.Getenv("HTTP_ADDR")
+	if addr == "" {
+		return
+	}
+
+	go func() {
+		log.Infof("HTTP server listening on %s", addr)
+		if err := http.ListenAndServe(addr, httpMux); err != nil {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+}
+
+// requireAdmin protects the pages taking over the logins. With
+// HTTP_ADMIN_TOKEN set they require it as the token query parameter, a bearer
+// token or the cookie set on success, otherwise they are only served to
+// localhost.
+func requireAdmin(handler http.Handler) http.Handler {
+	token := os.Getenv("HTTP_ADMIN_TOKEN")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			if !fromLoopback(r) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if given := r.URL.Query().Get("token"); given != "" && validToken(given, token) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     adminTokenCookie,
+				Value:    given,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && validToken(strings.TrimPrefix(auth, "Bearer "), token) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if cookie, err := r.Cookie(adminTokenCookie); err == nil && validToken(cookie.Value, token) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func validToken(given, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
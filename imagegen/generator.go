@@ -0,0 +1,39 @@
+package imagegen
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProviderOpenAI          = "openai"
+	ProviderStableDiffusion = "sd"
+
+	DefaultSize = "512x512"
+)
+
+// Generator turns a text prompt into an encoded image (PNG or JPEG).
+type Generator interface {
+	Generate(ctx context.Context, prompt string) ([]byte, error)
+}
+
+// ParseSize parses a size string like "512x512" into width and height.
+func ParseSize(size string) (int, int, error) {
+	parts := strings.SplitN(strings.ToLower(size), "x", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid image size: %s", size)
+	}
+
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("invalid image width: %s", size)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid image height: %s", size)
+	}
+
+	return width, height, nil
+}
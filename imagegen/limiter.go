@@ -0,0 +1,88 @@
+package imagegen
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows at most limit events per sliding window for each key.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+
+	events     map[string][]time.Time
+	eventsLock sync.Mutex
+	lastSweep  time.Time
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key if it is within the limit, and returns it
+// for Refund. Otherwise it returns false and how long to wait before the
+// next event is allowed.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration, time.Time) {
+	if rl.limit <= 0 {
+		return true, 0, time.Time{}
+	}
+
+	rl.eventsLock.Lock()
+	defer rl.eventsLock.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	events := rl.events[key]
+	for len(events) > 0 && now.Sub(events[0]) >= rl.window {
+		events = events[1:]
+	}
+
+	if len(events) >= rl.limit {
+		rl.events[key] = events
+		return false, rl.window - now.Sub(events[0]), time.Time{}
+	}
+
+	rl.events[key] = append(events, now)
+
+	return true, 0, now
+}
+
+// Refund forgets event of key returned by Allow, for an event which failed.
+func (rl *RateLimiter) Refund(key string, event time.Time) {
+	rl.eventsLock.Lock()
+	defer rl.eventsLock.Unlock()
+
+	events := rl.events[key]
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Equal(event) {
+			events = append(events[:i:i], events[i+1:]...)
+			break
+		}
+	}
+
+	if len(events) == 0 {
+		delete(rl.events, key)
+	} else {
+		rl.events[key] = events
+	}
+}
+
+// sweep deletes the keys without events in the window, at most once per
+// window. The caller must hold eventsLock.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rl.window {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, events := range rl.events {
+		if len(events) == 0 || now.Sub(events[len(events)-1]) >= rl.window {
+			delete(rl.events, key)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package imagegen
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := NewRateLimiter(2, 100*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := rl.Allow("alice"); !ok {
+			t.Fatalf("event %d is denied", i)
+		}
+	}
+	ok, wait, _ := rl.Allow("alice")
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("unexpected third event %v, wait %v", ok, wait)
+	}
+	if ok, _, _ := rl.Allow("bob"); !ok {
+		t.Error("keys share the limit")
+	}
+
+	time.Sleep(wait)
+	if ok, _, _ := rl.Allow("alice"); !ok {
+		t.Error("event is denied after the window")
+	}
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	rl := NewRateLimiter(2, time.Hour)
+
+	_, _, first := rl.Allow("alice")
+	time.Sleep(time.Millisecond)
+	_, _, second := rl.Allow("alice")
+
+	// The first event fails after the second one is recorded
+	rl.Refund("alice", first)
+	if events := rl.events["alice"]; len(events) != 1 || !events[0].Equal(second) {
+		t.Errorf("refund does not remove the failed event: %v", events)
+	}
+
+	if ok, _, _ := rl.Allow("alice"); !ok {
+		t.Error("refunded event still counts")
+	}
+	if ok, _, _ := rl.Allow("alice"); ok {
+		t.Error("limit is exceeded")
+	}
+
+	rl.Refund("alice", first)
+	if events := rl.events["alice"]; len(events) != 2 {
+		t.Errorf("refunding twice removes another event: %v", events)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	rl := NewRateLimiter(0, time.Hour)
+
+	for i := 0; i < 100; i++ {
+		if ok, _, _ := rl.Allow("alice"); !ok {
+			t.Fatal("unlimited event is denied")
+		}
+	}
+	if len(rl.events) != 0 {
+		t.Errorf("unlimited events are recorded: %v", rl.events)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	rl := NewRateLimiter(1, 50*time.Millisecond)
+
+	rl.Allow("alice")
+	time.Sleep(60 * time.Millisecond)
+	rl.Allow("bob")
+
+	if _, ok := rl.events["alice"]; ok {
+		t.Error("idle key is not swept")
+	}
+}
@@ -0,0 +1,123 @@
+package imagegen
+
+import (
+	"bytes"
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	DefaultOpenAIAddr = "https://api.openai.com/v1"
+
+	responseFormatB64 = "b64_json"
+)
+
+// openAISizes are the sizes accepted by the image generation API.
+var openAISizes = []string{"256x256", "512x512", "1024x1024"}
+
+type OpenAIGenerator struct {
+	httpClient *http.Client
+	addr       string
+	apiKey     string
+	size       string
+}
+
+func NewOpenAIGenerator(addr, apiKey, size string) (*OpenAIGenerator, error) {
+	if addr == "" {
+		addr = DefaultOpenAIAddr
+	}
+	if size == "" {
+		size = DefaultSize
+	}
+	size = strings.ToLower(size)
+	if !validOpenAISize(size) {
+		return nil, fmt.Errorf("invalid image size: %s, expect one of %s", size, strings.Join(openAISizes, ", "))
+	}
+
+	return &OpenAIGenerator{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+			},
+		},
+		addr:   addr,
+		apiKey: apiKey,
+		size:   size,
+	}, nil
+}
+
+func validOpenAISize(size string) bool {
+	for _, s := range openAISizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *OpenAIGenerator) Generate(ctx context.Context, prompt string) ([]byte, error) {
+	request := &OpenAIImageRequest{
+		Prompt:         prompt,
+		N:              1,
+		Size:           g.size,
+		ResponseFormat: responseFormatB64,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(request); err != nil {
+		return nil, err
+	}
+
+	url, _ := url.JoinPath(g.addr, "images", "generations")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", g.apiKey))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var imageResponse OpenAIImageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&imageResponse); err != nil {
+		return nil, err
+	}
+
+	if len(imageResponse.Data) == 0 {
+		return nil, errors.New("no image returned")
+	}
+
+	return b64.StdEncoding.DecodeString(imageResponse.Data[0].B64JSON)
+}
+
+type OpenAIImageRequest struct {
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+}
+
+type OpenAIImageResponse struct {
+	Created int64 `json:"created"`
+	Data    []struct {
+		B64JSON string `json:"b64_json"`
+	} `json:"data"`
+}
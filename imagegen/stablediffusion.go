@@ -0,0 +1,105 @@
+package imagegen
+
+import (
+	"bytes"
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const (
+	DefaultStableDiffusionAddr = "http://127.0.0.1:7860"
+
+	defaultSteps = 20
+)
+
+// StableDiffusionGenerator talks to the txt2img API of a local
+// stable-diffusion-webui server.
+type StableDiffusionGenerator struct {
+	httpClient *http.Client
+	addr       string
+	width      int
+	height     int
+}
+
+func NewStableDiffusionGenerator(addr, size string) (*StableDiffusionGenerator, error) {
+	if addr == "" {
+		addr = DefaultStableDiffusionAddr
+	}
+	if size == "" {
+		size = DefaultSize
+	}
+
+	width, height, err := ParseSize(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StableDiffusionGenerator{
+		httpClient: &http.Client{},
+		addr:       addr,
+		width:      width,
+		height:     height,
+	}, nil
+}
+
+func (g *StableDiffusionGenerator) Generate(ctx context.Context, prompt string) ([]byte, error) {
+	request := &Txt2ImgRequest{
+		Prompt: prompt,
+		Steps:  defaultSteps,
+		Width:  g.width,
+		Height: g.height,
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(request); err != nil {
+		return nil, err
+	}
+
+	url, _ := url.JoinPath(g.addr, "sdapi", "v1", "txt2img")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buf)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	}
+
+	var txt2ImgResponse Txt2ImgResponse
+	if err := json.NewDecoder(resp.Body).Decode(&txt2ImgResponse); err != nil {
+		return nil, err
+	}
+
+	if len(txt2ImgResponse.Images) == 0 {
+		return nil, errors.New("no image returned")
+	}
+
+	return b64.StdEncoding.DecodeString(txt2ImgResponse.Images[0])
+}
+
+type Txt2ImgRequest struct {
+	Prompt string `json:"prompt"`
+	Steps  int    `json:"steps,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+type Txt2ImgResponse struct {
+	Images []string `json:"images"`
+}
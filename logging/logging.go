@@ -0,0 +1,67 @@
+// Package logging is the logging facade shared by every package of the bot.
+// It wraps logrus and redacts passwords, tokens, cookies and session values
+// before anything is written.
+package logging
+
+import (
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	Fields = logrus.Fields
+	Entry  = logrus.Entry
+	Level  = logrus.Level
+)
+
+var logger = logrus.New()
+
+func init() {
+	logger.SetFormatter(&RedactFormatter{Formatter: logger.Formatter})
+
+	if level, err := logrus.ParseLevel(os.Getenv("LOG_LEVEL")); err == nil {
+		logger.SetLevel(level)
+	}
+}
+
+// Component returns an entry tagged with the name of a component.
+func Component(name string) *Entry {
+	return logger.WithField("component", name)
+}
+
+func WithField(key string, value interface{}) *Entry {
+	return logger.WithField(key, value)
+}
+
+func WithFields(fields Fields) *Entry {
+	return logger.WithFields(fields)
+}
+
+func WithError(err error) *Entry {
+	return logger.WithError(err)
+}
+
+func Debugf(format string, args ...interface{}) {
+	logger.Debugf(format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	logger.Infof(format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	logger.Warnf(format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logger.Errorf(format, args...)
+}
+
+func Fatal(args ...interface{}) {
+	logger.Fatal(args...)
+}
+
+func Fatalf(format string, args ...interface{}) {
+	logger.Fatalf(format, args...)
+}
@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	sensitiveKeys = []string{
+		"password",
+		"passwd",
+		"token",
+		"cookie",
+		"session",
+		"secret",
+		"authorization",
+		"clearance",
+	}
+
+	// sensitivePatterns are replaced by their first group followed by
+	// redacted, so the group keeps what tells the value apart
+	sensitivePatterns = []*regexp.Regexp{
+		// Cookie and Authorization headers as a whole, as in "Cookie: a=1; b=2",
+		// "cookie":"a=1; b=2" or map[Cookie:[a=1; b=2]]
+		regexp.MustCompile(`(?i)((?:set-)?cookie["']?\s*[:=]\s*["']?\[?|authorization["']?\s*[:=]\s*["']?\[?)[^"'\]\r\n]+`),
+		// Bearer tokens
+		regexp.MustCompile(`(?i)(bearer\s+)[^\s"',;]+`),
+		// JWT such as ChatGPT access tokens
+		regexp.MustCompile(`()eyJ[\w-]+\.[\w-]+\.[\w-]*`),
+		// key=value, key: value and "key":"value" pairs
+		regexp.MustCompile(`(?i)((?:password|passwd|[\w.-]*token|session[\w.-]*|secret|cf_clearance)["']?\s*[:=]\s*["']?)[^\s"'&,;]+`),
+	}
+
+	secrets     []string
+	secretsLock sync.RWMutex
+)
+
+// AddSecret registers a value which must never show up in the logs, such
+// as a configured password or session token.
+func AddSecret(secret string) {
+	if len(secret) < 4 {
+		return
+	}
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+
+	// Replace longer secrets first in case one contains another
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+}
+
+// Redact masks the secrets and the sensitive values found in s.
+func Redact(s string) string {
+	secretsLock.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	secretsLock.RUnlock()
+
+	for _, pattern := range sensitivePatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+redacted)
+	}
+
+	return s
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactFormatter redacts the message and the fields of an entry before
+// handing it to the wrapped formatter.
+type RedactFormatter struct {
+	Formatter logrus.Formatter
+}
+
+func (f *RedactFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	entry.Message = Redact(entry.Message)
+
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		if isSensitiveKey(key) {
+			data[key] = redacted
+			continue
+		}
+
+		switch v := value.(type) {
+		case nil, bool, int, int64, uint64, float64:
+			data[key] = v
+		default:
+			s := fmt.Sprint(v)
+			if r := Redact(s); r != s {
+				data[key] = r
+			} else {
+				data[key] = v
+			}
+		}
+	}
+	entry.Data = data
+
+	return f.Formatter.Format(entry)
+}
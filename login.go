@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+	"github.com/skip2/go-qrcode"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	qrCodeUrlPrefix = "https://login.weixin.qq.com/l/"
+	qrCodeSize      = 256
+
+	notifyTimeout = 10 * time.Second
+
+	eventLoginRequired = "login_required"
+	eventLoggedOut     = "logged_out"
+)
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>WeChat login</title>
+<meta http-equiv="refresh" content="5">
+</head>
+<body>
+{{if .}}
+<img src="?image={{.}}" alt="WeChat login QR code">
+<p>Scan with WeChat to log in.</p>
+{{else}}
+<p>No pending login.</p>
+{{end}}
+</body>
+</html>
+`))
+
+var (
+	loginUUID     string
+	loginUUIDLock sync.Mutex
+	loginWebhook  string
+)
+
+// initLogin shows the login QR code on the terminal and on the /login page,
+// and notifies LOGIN_WEBHOOK whenever someone has to scan it.
+func initLogin(bot *openwechat.Bot) {
+	loginWebhook = os.Getenv("LOGIN_WEBHOOK")
+
+	bot.UUIDCallback = func(uuid string) {
+		setLoginUUID(uuid)
+
+		if runtime.GOOS == "windows" {
+			openwechat.PrintlnQrcodeUrl(uuid)
+		} else {
+			q, _ := qrcode.New(qrCodeUrlPrefix+uuid, qrcode.Low)
+			fmt.Println(q.ToString(true))
+		}
+
+		notifyLogin(eventLoginRequired, "WeChat login required, scan the QR code to log in.", qrCodeUrlPrefix+uuid)
+	}
+
+	bot.LoginCallBack = func(body []byte) {
+		setLoginUUID("")
+	}
+
+	bot.LogoutCallBack = func(bot *openwechat.Bot) {
+		if !shuttingDown() {
+			notifyLogin(eventLoggedOut, "WeChat logged out, restart the bot to log in again.", "")
+		}
+	}
+
+	httpMux.Handle("/login", requireAdmin(http.HandlerFunc(serveLogin)))
+}
+
+func setLoginUUID(uuid string) {
+	loginUUIDLock.Lock()
+	defer loginUUIDLock.Unlock()
+
+	loginUUID = uuid
+}
+
+func getLoginUUID() string {
+	loginUUIDLock.Lock()
+	defer loginUUIDLock.Unlock()
+
+	return loginUUID
+}
+
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uuid := getLoginUUID()
+
+	if r.URL.Query().Get("image") != "" {
+		if uuid == "" {
+			http.NotFound(w, r)
+			return
+		}
+		png, err := qrcode.Encode(qrCodeUrlPrefix+uuid, qrcode.Medium, qrCodeSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(png)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	loginPage.Execute(w, uuid)
+}
+
+// notifyLogin posts the event to LOGIN_WEBHOOK in background.
+func notifyLogin(event, text, qrCodeUrl string) {
+	if loginWebhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"event":      event,
+		"text":       text,
+		"qrcode_url": qrCodeUrl,
+	})
+	if err != nil {
+		log.Warnf("Failed to encode login notification: %v", err)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, loginWebhook, bytes.NewReader(body))
+		if err != nil {
+			log.Warnf("Failed to notify login: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Warnf("Failed to notify login: %v", err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= http.StatusBadRequest {
+			log.Warnf("Failed to notify login: unexpected status code %d", resp.StatusCode)
+		}
+	}()
+}
@@ -1,154 +1,264 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
-	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/duo/wechatgpt/chatgpt"
+	"github.com/duo/wechatgpt/messaging"
+	"github.com/duo/wechatgpt/messaging/repl"
+	"github.com/duo/wechatgpt/metrics"
 
-	"github.com/eatmoreapple/openwechat"
-	"github.com/skip2/go-qrcode"
-
-	log "github.com/sirupsen/logrus"
+	log "github.com/duo/wechatgpt/logging"
 )
 
 const (
-	qrCodeUrlPrefix    = "https://login.weixin.qq.com/l/"
-	defaultTaskTimeout = 120 * time.Second
+	defaultTaskTimeout       = 120 * time.Second
+	defaultConversationStore = "conversations.json"
 )
 
 var (
-	autoAccept  bool
-	taskTimeout time.Duration
+	taskTimeout atomic.Int64
 )
 
 func main() {
-	autoAccept = strings.ToLower(os.Getenv("AUTO_ACCEPT")) == "true"
+	replMode := flag.Bool("repl", false, "chat in the terminal instead of the configured adapters")
+	flag.Parse()
 
 	timeout := os.Getenv("TASK_TIMEOUT")
 	if timeout == "" {
-		taskTimeout = defaultTaskTimeout
+		setTaskTimeout(defaultTaskTimeout)
 	} else {
 		duration, err := time.ParseDuration(timeout)
 		if err != nil {
 			log.Fatal(err)
 		}
-		taskTimeout = duration
+		setTaskTimeout(duration)
+	}
+
+	var contextTTL time.Duration
+	if ttl := os.Getenv("CONTEXT_TTL"); ttl != "" {
+		duration, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		contextTTL = duration
 	}
 
-	email := os.Getenv("CHATGPT_EMAIL")
-	password := os.Getenv("CHATGPT_PASSWORD")
-	sessionToken := os.Getenv("SESSION_TOKEN")
+	initDraw()
+	initFile()
+	initAdmin()
 
-	if email == "" && password == "" && sessionToken == "" {
-		log.Fatal("Login information is missing")
-	} else if sessionToken == "" && email != "" && password == "" {
-		log.Fatal("Password is empty")
-	} else if sessionToken == "" && email == "" && password != "" {
-		log.Fatal("Email is empty")
+	taskManager := chatgpt.NewTaskManager(newPool(loadAccounts()))
+	initQuota(taskManager)
+	janitorMaxAge := initConversationStore(taskManager)
+	taskManager.SetContextTTL(contextTTL)
+
+	var adapters []messaging.Adapter
+	if *replMode {
+		adapters = []messaging.Adapter{repl.New()}
+	} else {
+		adapters = initAdapters()
 	}
 
-	cfClearance := os.Getenv("CF_CLEARANCE")
-	userAgent := os.Getenv("USER_AGENT")
+	shutdown, stopped := initShutdown(adapters, taskManager)
+	initCaptcha(adapters, taskManager)
+	// Pruning may log in, which needs the captcha solver
+	if janitorMaxAge > 0 {
+		taskManager.StartJanitor(janitorMaxAge)
+	}
+	httpMux.Handle("/metrics", metrics.Handler())
+	initHealth(adapters, taskManager)
+	initAPI(taskManager)
+	startHTTPServer()
 
-	taskManager := chatgpt.NewTaskManager(email, password, sessionToken, userAgent, cfClearance)
+	// The REPL ends with its input, answer what was asked before leaving
+	runAdapters(adapters, taskManager, shutdown, stopped, *replMode)
+}
 
-	bot := openwechat.DefaultBot(openwechat.Desktop)
+// runAdapters returns once the bot is shut down, which an adapter stopping
+// on its own (WeChat logout for instance) also triggers. With drain the
+// queued tasks are answered before shutting down after an adapter stops.
+func runAdapters(adapters []messaging.Adapter, taskManager *chatgpt.TaskManager, shutdown func(reason string), stopped <-chan struct{}, drain bool) {
+	handler := func(msg *messaging.Message) {
+		handleMessage(msg, taskManager)
+	}
 
-	bot.MessageHandler = func(msg *openwechat.Message) {
-		handleMesasge(msg, taskManager)
+	type exit struct {
+		name string
+		err  error
 	}
 
-	bot.UUIDCallback = func(uuid string) {
-		if runtime.GOOS == "windows" {
-			openwechat.PrintlnQrcodeUrl(uuid)
+	done := make(chan exit, len(adapters))
+	for _, adapter := range adapters {
+		adapter := adapter
+		go func() {
+			done <- exit{adapter.Name(), adapter.Run(handler)}
+		}()
+	}
+
+	select {
+	case exit := <-done:
+		if exit.err != nil {
+			log.Errorf("%s failed: %v", exit.name, exit.err)
+			shutdown(exit.name + " failed")
 		} else {
-			q, _ := qrcode.New(qrCodeUrlPrefix+uuid, qrcode.Low)
-			fmt.Println(q.ToString(true))
+			if drain {
+				waitTasks(taskManager, stopped)
+			}
+			shutdown(exit.name + " stopped")
+		}
+		<-stopped
+		if exit.err != nil {
+			os.Exit(1)
 		}
+	case <-stopped:
 	}
+}
 
-	reloadStorage := openwechat.NewJsonFileHotReloadStorage("storage.json")
+// waitTasks waits for the queued and running tasks, unless the bot is shut
+// down meanwhile.
+func waitTasks(taskManager *chatgpt.TaskManager, stopped <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	err := bot.HotLogin(reloadStorage)
-	if err != nil {
-		if err = bot.Login(); err != nil {
-			log.Fatalf("login error: %v", err)
+	go func() {
+		select {
+		case <-stopped:
+			cancel()
+		case <-ctx.Done():
 		}
-	}
+	}()
 
-	bot.Block()
+	taskManager.Wait(ctx)
 }
 
-func handleMesasge(msg *openwechat.Message, taskManager *chatgpt.TaskManager) {
-	if msg.IsFriendAdd() {
-		if autoAccept {
-			_, err := msg.Agree("I'm a ChatGPT bot~")
-			if err != nil {
-				log.Warnf("Faild to agree friend request: %v", err)
-			}
+func handleMessage(msg *messaging.Message, taskManager *chatgpt.TaskManager) {
+	if shuttingDown() {
+		return
+	}
+
+	if msg.File != nil {
+		// Files can not mention the bot, so only accept them in private chat
+		if msg.Group == nil && !isBanned(msg.Sender.ID) {
+			handleFile(msg, taskManager)
 		}
 		return
 	}
 
-	if msg.IsSendBySelf() || (msg.IsSendByGroup() && !msg.IsAt()) || !msg.IsText() {
+	if msg.Group != nil && !msg.Mentioned {
 		return
 	}
 
-	log.Debugf("Receive msg: %s", msg.Content)
+	log.Debugf("Receive msg: %s", msg.Text)
 
-	content := strings.TrimSpace(msg.Content)
+	content := msg.Text
 	responsePrefix := ""
+	userID := msg.Sender.ID
+	groupID := ""
 
-	sender, err := msg.Sender()
-	if err != nil {
-		log.Warnf("Failed to get message sender: %v", err)
-		if _, err := msg.ReplyText("[ERROR] Failed to get message sender"); err != nil {
-			log.Warnf("Failed to reply: %v", err)
+	if msg.Group != nil {
+		responsePrefix = "@" + msg.Sender.Name + " "
+		groupID = msg.Group.ID
+
+		if isBanned(groupID) {
+			return
 		}
+	}
+
+	// Skip empty content and banned users
+	if content == "" || isBanned(userID) {
 		return
 	}
 
-	if msg.IsSendByGroup() {
-		groupSender, err := msg.SenderInGroup()
-		if err != nil {
-			log.Warnf("Failed to get group sender: %v", err)
-			if _, err := msg.ReplyText("[ERROR] Failed to get group sender"); err != nil {
-				log.Warnf("Failed to reply: %v", err)
-			}
-			return
-		}
-		responsePrefix = "@" + groupSender.NickName + " "
+	if msg.Group == nil && answerCaptcha(msg, userID, content) {
+		return
+	}
 
-		target := "@" + sender.Self.NickName
-		content = strings.TrimSpace(strings.ReplaceAll(msg.Content, target, ""))
+	if isAdminCommand(content) {
+		handleAdmin(msg, taskManager, content)
+		return
 	}
 
-	// Skip empty content
-	if content == "" {
+	if isDrawCommand(content) {
+		handleDraw(msg, userID, responsePrefix, content)
 		return
 	}
 
-	taskManager.SendTask(chatgpt.NewTask(
-		sender.ID(),
+	reply := newStreamReply(msg, responsePrefix)
+
+	task := chatgpt.NewTask(
+		msg.ChatID,
 		content,
-		taskTimeout,
+		getTaskTimeout(),
 		func(resp string, err error) {
+			text := responsePrefix + resp
 			if err != nil {
 				log.Warnf("Failed to get ChatGPT response: %v", err)
-				text := fmt.Sprintf("[ERROR] Failed to get ChatGPT response\n\n%v", err)
-				if _, err := msg.ReplyText(text); err != nil {
-					log.Warnf("Failed to reply: %v", err)
-				}
+				text = fmt.Sprintf("[ERROR] Failed to get ChatGPT response\n\n%v", err)
 			} else {
 				log.Debugf("ChatGPT response: %s", resp)
-				if _, err := msg.ReplyText(responsePrefix + resp); err != nil {
-					log.Warnf("Failed to reply: %v", err)
-				}
+			}
+
+			if reply != nil {
+				reply.finish(text)
+			} else {
+				replyText(msg, text)
 			}
 		},
-	))
+	).WithOwner(userID, groupID)
+	if reply != nil {
+		task.WithProgress(reply.progress)
+	}
+
+	taskManager.SendTask(task)
+}
+
+// initConversationStore returns the CONVERSATION_MAX_AGE the janitor prunes
+// conversations after, 0 if disabled.
+func initConversationStore(taskManager *chatgpt.TaskManager) time.Duration {
+	path := os.Getenv("CONVERSATION_STORE")
+	if path == "" {
+		path = defaultConversationStore
+	}
+
+	store, err := chatgpt.NewConversationStore(path)
+	if err != nil {
+		log.Fatalf("Failed to load conversations: %v", err)
+	}
+
+	taskManager.SetConversationStore(store)
+	taskManager.SetResetDelete(strings.ToLower(os.Getenv("RESET_DELETE")) == "true")
+
+	days := os.Getenv("CONVERSATION_MAX_AGE")
+	if days == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(days)
+	if err != nil || n <= 0 {
+		log.Fatalf("Invalid CONVERSATION_MAX_AGE: %s", days)
+	}
+	return time.Duration(n) * 24 * time.Hour
+}
+
+func getTaskTimeout() time.Duration {
+	return time.Duration(taskTimeout.Load())
+}
+
+func setTaskTimeout(timeout time.Duration) {
+	taskTimeout.Store(int64(timeout))
+}
+
+func replyText(msg *messaging.Message, text string) {
+	if err := msg.ReplyText(text); err != nil {
+		metrics.ReplyFailures.WithLabelValues(msg.Adapter.Name()).Inc()
+		log.Warnf("Failed to reply: %v", err)
+	}
 }
@@ -0,0 +1,97 @@
+// Package messaging abstracts the chat platforms the bot talks on, every
+// platform is an Adapter delivering Messages to the same handler.
+package messaging
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrFileTooLarge is returned by File.Download past its limit.
+var ErrFileTooLarge = errors.New("file is too large")
+
+// User is a contact or a group on a platform.
+type User struct {
+	ID   string
+	Name string
+}
+
+// File is a file attached to a message.
+type File struct {
+	Name string
+	// Size in bytes, negative if unknown before download
+	Size int64
+	// Download fails with ErrFileTooLarge if the file has more than limit
+	// bytes
+	Download func(limit int64) ([]byte, error)
+}
+
+// ReadAll reads r until EOF like io.ReadAll, failing with ErrFileTooLarge
+// past limit bytes.
+func ReadAll(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrFileTooLarge
+	}
+	return data, nil
+}
+
+// Replier answers a message in the chat it was received from.
+type Replier interface {
+	ReplyText(text string) error
+	ReplyImage(image []byte) error
+	ReplyFile(name string, data []byte) error
+}
+
+// StreamReplier is implemented by Repliers able to edit a sent reply, so
+// an answer is shown while it is generated.
+type StreamReplier interface {
+	ReplyStream(text string) (Stream, error)
+}
+
+// Stream is a reply being edited until it is finished.
+type Stream interface {
+	Update(text string) error
+	Finish(text string) error
+}
+
+// Message is a message received by an adapter.
+type Message struct {
+	Replier
+
+	Adapter Adapter
+	// ChatID identifies the chat, it is the sender in private chat and the
+	// group in group chat
+	ChatID string
+	Sender User
+	// Group is nil in private chat
+	Group *User
+	// Mentioned reports whether the bot is mentioned in group chat, adapters
+	// may drop group messages not mentioning the bot
+	Mentioned bool
+	// Text is the content with the mention of the bot removed
+	Text string
+	File *File
+}
+
+type Handler func(msg *Message)
+
+// Adapter connects the bot to a chat platform.
+type Adapter interface {
+	Name() string
+	// Run logs in and passes every received message to handler until
+	// the adapter is stopped or logged out.
+	Run(handler Handler) error
+	Stop() error
+	Alive() bool
+
+	SendText(userID string, text string) error
+	SendImage(userID string, image []byte) error
+	// ResolveUser returns the ID of the contact named name, or name itself.
+	ResolveUser(name string) string
+	// Broadcast sends text to every contact and group.
+	Broadcast(text string) error
+}
@@ -0,0 +1,230 @@
+// Package repl is a messaging adapter reading messages from a terminal, to
+// try the bot without any chat platform.
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/duo/wechatgpt/messaging"
+)
+
+const (
+	// IDPrefix keeps REPL IDs apart from the ones of other platforms
+	IDPrefix = "repl:"
+
+	defaultUser = "me"
+
+	cmdAs    = "/as"
+	cmdGroup = "/group"
+	cmdFile  = "/file"
+	cmdHelp  = "/help"
+
+	help = `Lines are sent as messages, except:
+/as <user>     send as user
+/group <name>  send in group name, mentioning the bot
+/group         back to private chat
+/file <path>   send a file`
+)
+
+type Adapter struct {
+	in  io.Reader
+	out io.Writer
+
+	alive atomic.Bool
+	// Replies are printed by task workers, with the prompt showing user
+	// and group
+	outLock sync.Mutex
+	user    string
+	group   string
+}
+
+// New creates an adapter reading stdin and printing to stdout.
+func New() *Adapter {
+	return &Adapter{in: os.Stdin, out: os.Stdout, user: defaultUser}
+}
+
+func (a *Adapter) Name() string {
+	return "repl"
+}
+
+func (a *Adapter) Run(handler messaging.Handler) error {
+	a.alive.Store(true)
+	defer a.alive.Store(false)
+
+	a.println(help)
+	a.prompt()
+
+	scanner := bufio.NewScanner(a.in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			a.handle(line, handler)
+		}
+		a.prompt()
+	}
+
+	return scanner.Err()
+}
+
+func (a *Adapter) Stop() error {
+	a.alive.Store(false)
+	return nil
+}
+
+func (a *Adapter) Alive() bool {
+	return a.alive.Load()
+}
+
+func (a *Adapter) handle(line string, handler messaging.Handler) {
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch command {
+	case cmdHelp:
+		a.println(help)
+		return
+	case cmdAs:
+		if arg == "" {
+			a.println("Usage: /as <user>")
+			return
+		}
+		a.outLock.Lock()
+		a.user = arg
+		a.outLock.Unlock()
+		return
+	case cmdGroup:
+		a.outLock.Lock()
+		a.group = arg
+		a.outLock.Unlock()
+		return
+	}
+
+	a.outLock.Lock()
+	user, group, chat := a.user, a.group, a.chat()
+	a.outLock.Unlock()
+
+	msg := &messaging.Message{
+		Replier: &replier{adapter: a, chat: chat},
+		Adapter: a,
+		ChatID:  IDPrefix + user,
+		Sender:  messaging.User{ID: IDPrefix + user, Name: user},
+		Text:    line,
+	}
+
+	if command == cmdFile {
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			a.println(err.Error())
+			return
+		}
+		msg.Text = ""
+		msg.File = &messaging.File{
+			Name: filepath.Base(arg),
+			Size: int64(len(data)),
+			Download: func(limit int64) ([]byte, error) {
+				if int64(len(data)) > limit {
+					return nil, messaging.ErrFileTooLarge
+				}
+				return data, nil
+			},
+		}
+	}
+
+	if group != "" {
+		msg.Group = &messaging.User{ID: IDPrefix + "group:" + group, Name: group}
+		msg.ChatID = msg.Group.ID
+		msg.Mentioned = true
+	}
+
+	handler(msg)
+}
+
+// chat names the chat messages are sent to. The caller must hold outLock.
+func (a *Adapter) chat() string {
+	if a.group != "" {
+		return a.user + "@" + a.group
+	}
+	return a.user
+}
+
+func (a *Adapter) prompt() {
+	a.outLock.Lock()
+	defer a.outLock.Unlock()
+
+	fmt.Fprintf(a.out, "%s> ", a.chat())
+}
+
+func (a *Adapter) println(text string) {
+	a.outLock.Lock()
+	defer a.outLock.Unlock()
+
+	fmt.Fprintln(a.out, text)
+}
+
+// reply prints text sent to chat, then the prompt again since the reply
+// arrives while waiting for input.
+func (a *Adapter) reply(chat string, text string) {
+	a.println(fmt.Sprintf("\n[bot -> %s] %s", chat, text))
+	a.prompt()
+}
+
+func (a *Adapter) SendText(userID string, text string) error {
+	a.reply(strings.TrimPrefix(userID, IDPrefix), text)
+	return nil
+}
+
+func (a *Adapter) SendImage(userID string, image []byte) error {
+	return a.save(strings.TrimPrefix(userID, IDPrefix), "wechatgpt-*.png", image)
+}
+
+func (a *Adapter) ResolveUser(name string) string {
+	if strings.HasPrefix(name, IDPrefix) {
+		return name
+	}
+	return IDPrefix + name
+}
+
+func (a *Adapter) Broadcast(text string) error {
+	return a.SendText("everyone", text)
+}
+
+// save writes media to a temporary file and prints its path.
+func (a *Adapter) save(chat, pattern string, data []byte) error {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	a.reply(chat, "file saved to "+f.Name())
+	return nil
+}
+
+type replier struct {
+	adapter *Adapter
+	chat    string
+}
+
+func (r *replier) ReplyText(text string) error {
+	r.adapter.reply(r.chat, text)
+	return nil
+}
+
+func (r *replier) ReplyImage(image []byte) error {
+	return r.adapter.save(r.chat, "wechatgpt-*.png", image)
+}
+
+func (r *replier) ReplyFile(name string, data []byte) error {
+	return r.adapter.save(r.chat, "wechatgpt-*-"+filepath.Base(name), data)
+}
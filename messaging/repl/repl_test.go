@@ -0,0 +1,120 @@
+package repl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/duo/wechatgpt/messaging"
+)
+
+const testTimeout = 5 * time.Second
+
+func receive(t *testing.T, messages <-chan *messaging.Message) *messaging.Message {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("no message is received")
+		return nil
+	}
+}
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte("some notes"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	in, input := io.Pipe()
+	var out bytes.Buffer
+	a := &Adapter{in: in, out: &out, user: defaultUser}
+
+	messages := make(chan *messaging.Message, 8)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Run(func(msg *messaging.Message) {
+			messages <- msg
+		})
+	}()
+	send := func(line string) {
+		if _, err := io.WriteString(input, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var received []*messaging.Message
+	send("hello")
+	received = append(received, receive(t, messages))
+
+	// Replies are printed by task workers while switching chats
+	hello := received[0]
+	replied := make(chan struct{})
+	go func() {
+		defer close(replied)
+		for i := 0; i < 100; i++ {
+			hello.ReplyText("echo: hello")
+		}
+	}()
+	send("/as bob")
+	send("/group team")
+	send("hi")
+	received = append(received, receive(t, messages))
+	<-replied
+
+	send("/group")
+	received[1].ReplyText("echo: hi")
+	send("/file " + path)
+	received = append(received, receive(t, messages))
+	send("")
+	send("/as")
+
+	input.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("adapter does not stop at the end of input")
+	}
+
+	if msg := received[0]; msg.Text != "hello" || msg.ChatID != "repl:me" || msg.Group != nil {
+		t.Errorf("unexpected private message %+v", msg)
+	}
+
+	msg := received[1]
+	if msg.Text != "hi" || msg.Sender.ID != "repl:bob" || !msg.Mentioned ||
+		msg.Group == nil || msg.Group.ID != "repl:group:team" || msg.ChatID != msg.Group.ID {
+		t.Errorf("unexpected group message %+v", msg)
+	}
+
+	msg = received[2]
+	if msg.Group != nil || msg.File == nil || msg.File.Name != "notes.txt" {
+		t.Fatalf("unexpected file message %+v", msg)
+	}
+	if data, err := msg.File.Download(100); err != nil || string(data) != "some notes" {
+		t.Errorf("unexpected download %q, %v", data, err)
+	}
+	if _, err := msg.File.Download(1); !errors.Is(err, messaging.ErrFileTooLarge) {
+		t.Errorf("expect file too large, got %v", err)
+	}
+
+	for _, want := range []string{
+		"[bot -> me] echo: hello",
+		"[bot -> bob@team] echo: hi",
+		"bob@team> ",
+		"Usage: /as <user>",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output misses %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,563 @@
+// Package telegram is the messaging adapter of Telegram bots, receiving
+// messages by long polling the Bot API.
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/duo/wechatgpt/messaging"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	DefaultAPIAddr = "https://api.telegram.org"
+
+	// IDPrefix keeps Telegram IDs apart from the ones of other platforms
+	IDPrefix = "tg:"
+
+	pollTimeout    = 30 * time.Second
+	retryDelay     = 5 * time.Second
+	requestTimeout = time.Minute
+	broadcastDelay = time.Second
+
+	// Telegram rejects longer messages, counted in UTF-16 code units
+	maxMessageLength = 4096
+)
+
+type Adapter struct {
+	apiAddr string
+	token   string
+	client  *http.Client
+
+	self  user
+	alive atomic.Bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Telegram has no contact list, broadcast goes to the chats seen
+	chats     map[int64]bool
+	chatsLock sync.Mutex
+}
+
+// New creates an adapter of the bot of token, apiAddr defaults to
+// DefaultAPIAddr.
+func New(apiAddr, token string) *Adapter {
+	if apiAddr == "" {
+		apiAddr = DefaultAPIAddr
+	}
+	log.AddSecret(token)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Adapter{
+		apiAddr: strings.TrimSuffix(apiAddr, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: pollTimeout + requestTimeout},
+		ctx:     ctx,
+		cancel:  cancel,
+		chats:   make(map[int64]bool),
+	}
+}
+
+type response struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+type user struct {
+	ID        int64  `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+func (u *user) name() string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+type chat struct {
+	ID    int64  `json:"id"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+}
+
+type entity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+type document struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
+}
+
+type message struct {
+	MessageID      int64     `json:"message_id"`
+	From           *user     `json:"from"`
+	Chat           chat      `json:"chat"`
+	Text           string    `json:"text"`
+	Caption        string    `json:"caption"`
+	Entities       []entity  `json:"entities"`
+	Document       *document `json:"document"`
+	ReplyToMessage *message  `json:"reply_to_message"`
+}
+
+type update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *message `json:"message"`
+}
+
+type file struct {
+	FilePath string `json:"file_path"`
+}
+
+func (a *Adapter) Name() string {
+	return "telegram"
+}
+
+func (a *Adapter) Run(handler messaging.Handler) error {
+	if err := a.call(a.ctx, "getMe", nil, &a.self); err != nil {
+		return fmt.Errorf("login error: %w", err)
+	}
+	a.alive.Store(true)
+	log.Infof("Telegram bot @%s started", a.self.Username)
+
+	var offset int64
+	for {
+		var updates []update
+		params := url.Values{
+			"offset":          {strconv.FormatInt(offset, 10)},
+			"timeout":         {strconv.Itoa(int(pollTimeout.Seconds()))},
+			"allowed_updates": {`["message"]`},
+		}
+
+		if err := a.call(a.ctx, "getUpdates", params, &updates); err != nil {
+			if a.ctx.Err() != nil {
+				return nil
+			}
+			a.alive.Store(false)
+			log.Warnf("Failed to get Telegram updates: %v", err)
+
+			select {
+			case <-time.After(retryDelay):
+				continue
+			case <-a.ctx.Done():
+				return nil
+			}
+		}
+		a.alive.Store(true)
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				a.handle(u.Message, handler)
+			}
+		}
+	}
+}
+
+func (a *Adapter) Stop() error {
+	a.alive.Store(false)
+	a.cancel()
+	return nil
+}
+
+func (a *Adapter) Alive() bool {
+	return a.alive.Load()
+}
+
+func (a *Adapter) handle(msg *message, handler messaging.Handler) {
+	if msg.From == nil || msg.From.ID == a.self.ID {
+		return
+	}
+
+	a.chatsLock.Lock()
+	a.chats[msg.Chat.ID] = true
+	a.chatsLock.Unlock()
+
+	m := &messaging.Message{
+		Replier: &replier{adapter: a, chatID: msg.Chat.ID},
+		Adapter: a,
+		ChatID:  formatID(msg.Chat.ID),
+		Sender:  messaging.User{ID: formatID(msg.From.ID), Name: msg.From.name()},
+		Text:    strings.TrimSpace(msg.Text),
+	}
+
+	if msg.Document != nil {
+		doc := msg.Document
+		m.File = &messaging.File{
+			Name: doc.FileName,
+			Size: doc.FileSize,
+			Download: func(limit int64) ([]byte, error) {
+				return a.download(doc.FileID, limit)
+			},
+		}
+		m.Text = strings.TrimSpace(msg.Caption)
+	}
+
+	if msg.Chat.Type != "private" {
+		m.Group = &messaging.User{ID: formatID(msg.Chat.ID), Name: msg.Chat.Title}
+		m.Mentioned, m.Text = a.mention(msg)
+		// Reply to the message in groups, the sender is mentioned this way
+		m.Replier = &replier{adapter: a, chatID: msg.Chat.ID, replyTo: msg.MessageID}
+	}
+
+	// Messages are handled in order, except files which are downloaded
+	// without stalling the polling
+	if m.File != nil {
+		go handler(m)
+		return
+	}
+	handler(m)
+}
+
+// mention reports whether msg mentions the bot or replies to it, and
+// returns the text without the mention.
+func (a *Adapter) mention(msg *message) (bool, string) {
+	if msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.ID == a.self.ID {
+		return true, strings.TrimSpace(msg.Text)
+	}
+
+	target := "@" + a.self.Username
+	for _, e := range msg.Entities {
+		if e.Type != "mention" {
+			continue
+		}
+		// Offsets are in UTF-16 code units
+		if mention := utf16Slice(msg.Text, e.Offset, e.Length); strings.EqualFold(mention, target) {
+			text := strings.Replace(msg.Text, mention, "", 1)
+			return true, strings.TrimSpace(text)
+		}
+	}
+
+	return false, strings.TrimSpace(msg.Text)
+}
+
+func (a *Adapter) SendText(userID string, text string) error {
+	chatID, err := parseID(userID)
+	if err != nil {
+		return err
+	}
+	return (&replier{adapter: a, chatID: chatID}).ReplyText(text)
+}
+
+func (a *Adapter) SendImage(userID string, image []byte) error {
+	chatID, err := parseID(userID)
+	if err != nil {
+		return err
+	}
+	return (&replier{adapter: a, chatID: chatID}).ReplyImage(image)
+}
+
+// ResolveUser only accepts IDs, bots can not look up users by name.
+func (a *Adapter) ResolveUser(name string) string {
+	return name
+}
+
+func (a *Adapter) Broadcast(text string) error {
+	a.chatsLock.Lock()
+	chats := make([]int64, 0, len(a.chats))
+	for id := range a.chats {
+		chats = append(chats, id)
+	}
+	a.chatsLock.Unlock()
+
+	for _, id := range chats {
+		if err := (&replier{adapter: a, chatID: id}).ReplyText(text); err != nil {
+			return err
+		}
+		time.Sleep(broadcastDelay)
+	}
+
+	return nil
+}
+
+func (a *Adapter) download(fileID string, limit int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(a.ctx, requestTimeout)
+	defer cancel()
+
+	var f file
+	if err := a.call(ctx, "getFile", url.Values{"file_id": {fileID}}, &f); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.apiAddr+"/file/bot"+a.token+"/"+f.FilePath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return messaging.ReadAll(resp.Body, limit)
+}
+
+// call invokes a Bot API method with form params and decodes its result
+// into out if not nil.
+func (a *Adapter) call(ctx context.Context, method string, params url.Values, out interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	return a.do(ctx, method, "application/x-www-form-urlencoded", strings.NewReader(params.Encode()), out)
+}
+
+// upload invokes a Bot API method sending data as the file field.
+func (a *Adapter) upload(method string, params url.Values, field, name string, data []byte, out interface{}) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for key, values := range params {
+		for _, value := range values {
+			w.WriteField(key, value)
+		}
+	}
+	part, err := w.CreateFormFile(field, name)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(a.ctx, requestTimeout)
+	defer cancel()
+
+	return a.do(ctx, method, w.FormDataContentType(), &body, out)
+}
+
+func (a *Adapter) do(ctx context.Context, method, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.apiAddr+"/bot"+a.token+"/"+method, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("%s: unexpected response with status code %d: %w", method, resp.StatusCode, err)
+	}
+	if !r.OK {
+		return fmt.Errorf("%s: %d %s", method, r.ErrorCode, r.Description)
+	}
+
+	if out != nil {
+		return json.Unmarshal(r.Result, out)
+	}
+	return nil
+}
+
+type replier struct {
+	adapter *Adapter
+	chatID  int64
+	replyTo int64
+}
+
+func (r *replier) params(extra url.Values) url.Values {
+	params := url.Values{"chat_id": {strconv.FormatInt(r.chatID, 10)}}
+	if r.replyTo != 0 {
+		params.Set("reply_to_message_id", strconv.FormatInt(r.replyTo, 10))
+		params.Set("allow_sending_without_reply", "true")
+	}
+	for key, values := range extra {
+		params[key] = values
+	}
+	return params
+}
+
+func (r *replier) send(text string) (*message, error) {
+	ctx, cancel := context.WithTimeout(r.adapter.ctx, requestTimeout)
+	defer cancel()
+
+	var sent message
+	err := r.adapter.call(ctx, "sendMessage", r.params(url.Values{"text": {text}}), &sent)
+	return &sent, err
+}
+
+func (r *replier) ReplyText(text string) error {
+	for _, chunk := range split(text) {
+		if blank(chunk) {
+			continue
+		}
+		if _, err := r.send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *replier) ReplyImage(image []byte) error {
+	return r.adapter.upload("sendPhoto", r.params(nil), "photo", "image.png", image, nil)
+}
+
+func (r *replier) ReplyFile(name string, data []byte) error {
+	return r.adapter.upload("sendDocument", r.params(nil), "document", name, data, nil)
+}
+
+func (r *replier) ReplyStream(text string) (messaging.Stream, error) {
+	s := &stream{replier: r}
+	if err := s.edit(truncate(text)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// stream edits a sent message as the answer grows, the message is sent
+// with the first text which is not blank.
+type stream struct {
+	replier   *replier
+	messageID int64
+	text      string
+}
+
+func (s *stream) Update(text string) error {
+	return s.edit(truncate(text))
+}
+
+// Finish edits the message with the first part of text and sends the rest
+// as new messages.
+func (s *stream) Finish(text string) error {
+	chunks := split(text)
+	if err := s.edit(chunks[0]); err != nil {
+		return err
+	}
+	for _, chunk := range chunks[1:] {
+		if blank(chunk) {
+			continue
+		}
+		if _, err := s.replier.send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *stream) edit(text string) error {
+	// Telegram rejects blank messages and edits not changing the message
+	if text == s.text || blank(text) {
+		return nil
+	}
+
+	if s.messageID == 0 {
+		sent, err := s.replier.send(text)
+		if err != nil {
+			return err
+		}
+		s.messageID = sent.MessageID
+		s.text = text
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(s.replier.adapter.ctx, requestTimeout)
+	defer cancel()
+
+	params := url.Values{
+		"chat_id":    {strconv.FormatInt(s.replier.chatID, 10)},
+		"message_id": {strconv.FormatInt(s.messageID, 10)},
+		"text":       {text},
+	}
+	if err := s.replier.adapter.call(ctx, "editMessageText", params, nil); err != nil {
+		return err
+	}
+	s.text = text
+
+	return nil
+}
+
+func formatID(id int64) string {
+	return IDPrefix + strconv.FormatInt(id, 10)
+}
+
+func parseID(id string) (int64, error) {
+	if !strings.HasPrefix(id, IDPrefix) {
+		return 0, errors.New("not a Telegram ID: " + id)
+	}
+	return strconv.ParseInt(strings.TrimPrefix(id, IDPrefix), 10, 64)
+}
+
+// split cuts text into messages Telegram accepts.
+func split(text string) []string {
+	var chunks []string
+	start, units := 0, 0
+	for i, r := range text {
+		if units+utf16Len(r) > maxMessageLength {
+			chunks = append(chunks, text[start:i])
+			start, units = i, 0
+		}
+		units += utf16Len(r)
+	}
+	return append(chunks, text[start:])
+}
+
+func blank(text string) bool {
+	return strings.TrimSpace(text) == ""
+}
+
+func truncate(text string) string {
+	return split(text)[0]
+}
+
+// utf16Slice returns the part of text at the offset and length counted in
+// UTF-16 code units.
+func utf16Slice(text string, offset, length int) string {
+	units := 0
+	start, end := -1, len(text)
+	for i, r := range text {
+		if units == offset {
+			start = i
+		}
+		if units == offset+length {
+			end = i
+			break
+		}
+		units += utf16Len(r)
+	}
+	if start < 0 {
+		return ""
+	}
+	return text[start:end]
+}
+
+// utf16Len returns the number of UTF-16 code units encoding r.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
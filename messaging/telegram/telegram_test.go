@@ -0,0 +1,243 @@
+package telegram
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/duo/wechatgpt/messaging"
+)
+
+const (
+	testToken   = "123:secret"
+	testTimeout = 5 * time.Second
+)
+
+// fakeAPI answers the Bot API methods used by the adapter, serving updates
+// once and recording the calls.
+type fakeAPI struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	updates []update
+	calls   []call
+}
+
+type call struct {
+	method string
+	params map[string]string
+}
+
+func newFakeAPI(t *testing.T, updates ...update) *fakeAPI {
+	f := &fakeAPI{updates: updates}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/file/bot"+testToken+"/docs/report.txt" {
+		w.Write([]byte(strings.Repeat("x", 100)))
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, "/bot"+testToken+"/")
+	if method == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	r.ParseMultipartForm(1 << 20)
+	params := make(map[string]string)
+	for key := range r.Form {
+		params[key] = r.Form.Get(key)
+	}
+
+	f.lock.Lock()
+	f.calls = append(f.calls, call{method, params})
+	var result interface{}
+	switch method {
+	case "getMe":
+		result = user{ID: 1, Username: "testbot"}
+	case "getUpdates":
+		result = f.updates
+		f.updates = nil
+	case "getFile":
+		result = file{FilePath: "docs/report.txt"}
+	case "sendMessage":
+		result = message{MessageID: int64(len(f.calls))}
+	default:
+		result = true
+	}
+	f.lock.Unlock()
+
+	if method == "getUpdates" && result.([]update) == nil {
+		// Long polling without updates
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+		result = []update{}
+	}
+
+	data, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(response{OK: true, Result: data})
+}
+
+// sent returns the calls of method.
+func (f *fakeAPI) sent(method string) []call {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var calls []call
+	for _, c := range f.calls {
+		if c.method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+func textUpdate(id int64, chat chat, text string, entities ...entity) update {
+	return update{UpdateID: id, Message: &message{
+		MessageID: id,
+		From:      &user{ID: 42, Username: "alice"},
+		Chat:      chat,
+		Text:      text,
+		Entities:  entities,
+	}}
+}
+
+// run runs a until the test ends and returns where messages are handed.
+func run(t *testing.T, a *Adapter) <-chan *messaging.Message {
+	received := make(chan *messaging.Message, 16)
+	go a.Run(func(msg *messaging.Message) {
+		received <- msg
+	})
+	t.Cleanup(func() { a.Stop() })
+	return received
+}
+
+func receive(t *testing.T, received <-chan *messaging.Message) *messaging.Message {
+	t.Helper()
+
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("no message is received")
+		return nil
+	}
+}
+
+func TestRunDeliversInOrder(t *testing.T) {
+	private := chat{ID: 42, Type: "private"}
+	group := chat{ID: -7, Type: "group", Title: "friends"}
+
+	fake := newFakeAPI(t,
+		textUpdate(1, private, "one"),
+		textUpdate(2, private, "two"),
+		// "😀" takes two UTF-16 code units
+		textUpdate(3, group, "😀 @testbot three", entity{Type: "mention", Offset: 3, Length: 8}),
+		textUpdate(4, group, "not for the bot"),
+	)
+	received := run(t, New(fake.URL, testToken))
+
+	for _, want := range []string{"one", "two"} {
+		msg := receive(t, received)
+		if msg.Text != want || msg.ChatID != "tg:42" || msg.Group != nil {
+			t.Errorf("unexpected message %+v, expect %q", msg, want)
+		}
+	}
+
+	msg := receive(t, received)
+	if msg.Text != "😀  three" || !msg.Mentioned || msg.Group == nil || msg.Group.ID != "tg:-7" {
+		t.Errorf("unexpected group message %+v", msg)
+	}
+	if msg := receive(t, received); msg.Mentioned {
+		t.Errorf("message without mention is mentioned: %+v", msg)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	fake := newFakeAPI(t, update{UpdateID: 1, Message: &message{
+		MessageID: 1,
+		From:      &user{ID: 42},
+		Chat:      chat{ID: 42, Type: "private"},
+		Document:  &document{FileID: "f1", FileName: "report.txt", FileSize: -1},
+	}})
+	msg := receive(t, run(t, New(fake.URL, testToken)))
+
+	if data, err := msg.File.Download(100); err != nil || len(data) != 100 {
+		t.Errorf("unexpected download %d bytes, %v", len(data), err)
+	}
+	if _, err := msg.File.Download(99); !errors.Is(err, messaging.ErrFileTooLarge) {
+		t.Errorf("expect file too large, got %v", err)
+	}
+}
+
+func TestReplyText(t *testing.T) {
+	fake := newFakeAPI(t)
+	r := &replier{adapter: New(fake.URL, testToken), chatID: 42, replyTo: 7}
+
+	text := strings.Repeat("😀", 3000)
+	if err := r.ReplyText(text); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReplyText(" \n"); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := fake.sent("sendMessage")
+	if len(calls) != 2 {
+		t.Fatalf("expect 2 messages, got %d", len(calls))
+	}
+	var joined string
+	for _, c := range calls {
+		if n := len(utf16.Encode([]rune(c.params["text"]))); n > maxMessageLength {
+			t.Errorf("message of %d UTF-16 code units", n)
+		}
+		if c.params["chat_id"] != "42" || c.params["reply_to_message_id"] != "7" {
+			t.Errorf("unexpected params %v", c.params)
+		}
+		joined += c.params["text"]
+	}
+	if joined != text {
+		t.Error("split loses text")
+	}
+}
+
+func TestReplyStream(t *testing.T) {
+	fake := newFakeAPI(t)
+	r := &replier{adapter: New(fake.URL, testToken), chatID: 42}
+
+	stream, err := r.ReplyStream("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := fake.sent("sendMessage"); len(calls) != 0 {
+		t.Fatalf("blank stream is sent: %v", calls)
+	}
+
+	if err := stream.Update("Hel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Update("Hel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Finish("Hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := fake.sent("sendMessage"); len(calls) != 1 || calls[0].params["text"] != "Hel" {
+		t.Errorf("unexpected messages %v", calls)
+	}
+	if calls := fake.sent("editMessageText"); len(calls) != 1 || calls[0].params["text"] != "Hello" {
+		t.Errorf("unexpected edits %v", calls)
+	}
+}
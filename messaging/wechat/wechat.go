@@ -0,0 +1,320 @@
+// Package wechat is the messaging adapter of personal WeChat accounts,
+// logged in through openwechat.
+package wechat
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/duo/wechatgpt/messaging"
+	"github.com/duo/wechatgpt/metrics"
+
+	"github.com/eatmoreapple/openwechat"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	broadcastDelay = time.Second
+	friendGreeting = "I'm a ChatGPT bot~"
+)
+
+type Adapter struct {
+	bot         *openwechat.Bot
+	storagePath string
+	autoAccept  bool
+	logout      bool
+}
+
+// New creates an adapter of bot, hot login data is kept in storagePath.
+func New(bot *openwechat.Bot, storagePath string) *Adapter {
+	return &Adapter{
+		bot:         bot,
+		storagePath: storagePath,
+		logout:      true,
+	}
+}
+
+// SetAutoAccept makes the bot agree every friend request.
+func (a *Adapter) SetAutoAccept(enabled bool) {
+	a.autoAccept = enabled
+}
+
+// SetLogoutOnStop chooses whether Stop logs out, or keeps the session for
+// hot login.
+func (a *Adapter) SetLogoutOnStop(enabled bool) {
+	a.logout = enabled
+}
+
+func (a *Adapter) Name() string {
+	return "wechat"
+}
+
+func (a *Adapter) Run(handler messaging.Handler) error {
+	a.bot.MessageHandler = func(msg *openwechat.Message) {
+		a.handle(msg, handler)
+	}
+
+	reloadStorage := openwechat.NewJsonFileHotReloadStorage(a.storagePath)
+
+	if err := a.bot.HotLogin(reloadStorage); err != nil {
+		if err = a.bot.Login(); err != nil {
+			return fmt.Errorf("login error: %w", err)
+		}
+	}
+
+	return a.bot.Block()
+}
+
+func (a *Adapter) Stop() error {
+	var err error
+	if a.logout && a.bot.Alive() {
+		err = a.bot.Logout()
+	}
+	a.bot.Exit()
+
+	return err
+}
+
+func (a *Adapter) Alive() bool {
+	return a.bot.Alive()
+}
+
+func (a *Adapter) handle(msg *openwechat.Message, handler messaging.Handler) {
+	if msg.IsFriendAdd() {
+		if a.autoAccept {
+			if _, err := msg.Agree(friendGreeting); err != nil {
+				log.Warnf("Faild to agree friend request: %v", err)
+			}
+		}
+		return
+	}
+
+	if msg.IsSendBySelf() {
+		return
+	}
+
+	isFile := msg.IsMedia() && msg.AppMsgType == openwechat.AppMsgTypeAttach
+
+	// Files can not mention the bot, so only accept them in private chat
+	if (msg.IsSendByGroup() && (isFile || !msg.IsAt())) || (!isFile && !msg.IsText()) {
+		return
+	}
+
+	sender, err := msg.Sender()
+	if err != nil {
+		log.Warnf("Failed to get message sender: %v", err)
+		if !isFile {
+			a.replyError(msg, "[ERROR] Failed to get message sender")
+		}
+		return
+	}
+
+	m := &messaging.Message{
+		Replier: &replier{msg: msg},
+		Adapter: a,
+		ChatID:  sender.ID(),
+		Sender:  messaging.User{ID: sender.ID(), Name: sender.NickName},
+		Text:    strings.TrimSpace(msg.Content),
+	}
+
+	if isFile {
+		size, err := strconv.ParseInt(msg.FileSize, 10, 64)
+		if err != nil {
+			size = -1
+		}
+		m.Text = ""
+		m.File = &messaging.File{
+			Name: msg.FileName,
+			Size: size,
+			Download: func(limit int64) ([]byte, error) {
+				resp, err := msg.GetFile()
+				if err != nil {
+					return nil, err
+				}
+				defer resp.Body.Close()
+
+				return messaging.ReadAll(resp.Body, limit)
+			},
+		}
+	}
+
+	if msg.IsSendByGroup() {
+		groupSender, err := msg.SenderInGroup()
+		if err != nil {
+			log.Warnf("Failed to get group sender: %v", err)
+			a.replyError(msg, "[ERROR] Failed to get group sender")
+			return
+		}
+
+		m.Group = &messaging.User{ID: sender.ID(), Name: sender.NickName}
+		m.Sender = messaging.User{ID: groupSender.ID(), Name: groupSender.NickName}
+		m.Mentioned = true
+
+		target := "@" + sender.Self.NickName
+		m.Text = strings.TrimSpace(strings.ReplaceAll(msg.Content, target, ""))
+	}
+
+	handler(m)
+}
+
+// replyError answers msg with text when it can not be handled.
+func (a *Adapter) replyError(msg *openwechat.Message, text string) {
+	if _, err := msg.ReplyText(text); err != nil {
+		metrics.ReplyFailures.WithLabelValues(a.Name()).Inc()
+		log.Warnf("Failed to reply: %v", err)
+	}
+}
+
+func (a *Adapter) SendText(userID string, text string) error {
+	friend, err := a.friend(userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = friend.SendText(text)
+	return err
+}
+
+func (a *Adapter) SendImage(userID string, image []byte) error {
+	friend, err := a.friend(userID)
+	if err != nil {
+		return err
+	}
+
+	return withTempFile("wechatgpt-*.png", image, func(f *os.File) error {
+		_, err := friend.SendImage(f)
+		return err
+	})
+}
+
+func (a *Adapter) friend(userID string) (*openwechat.Friend, error) {
+	self, err := a.bot.GetCurrentUser()
+	if err != nil {
+		return nil, err
+	}
+
+	friends, err := self.Friends()
+	if err != nil {
+		return nil, err
+	}
+
+	friend := friends.Search(1, func(friend *openwechat.Friend) bool {
+		return friend.ID() == userID
+	}).First()
+	if friend == nil {
+		return nil, errors.New("not a friend: " + userID)
+	}
+
+	return friend, nil
+}
+
+// ResolveUser accepts a stable ID, or the remark/nick name of a friend.
+func (a *Adapter) ResolveUser(name string) string {
+	self, err := a.bot.GetCurrentUser()
+	if err != nil {
+		return name
+	}
+
+	friends, err := self.Friends()
+	if err != nil {
+		return name
+	}
+
+	if friend := friends.GetByRemarkName(name); friend != nil {
+		return friend.ID()
+	}
+	if friend := friends.GetByNickName(name); friend != nil {
+		return friend.ID()
+	}
+
+	return name
+}
+
+func (a *Adapter) Broadcast(text string) error {
+	self, err := a.bot.GetCurrentUser()
+	if err != nil {
+		return err
+	}
+
+	friends, err := self.Friends()
+	if err != nil {
+		return err
+	}
+	if err := friends.SendText(text, broadcastDelay); err != nil {
+		return err
+	}
+
+	groups, err := self.Groups()
+	if err != nil {
+		return err
+	}
+	return groups.SendText(text, broadcastDelay)
+}
+
+type replier struct {
+	msg *openwechat.Message
+}
+
+func (r *replier) ReplyText(text string) error {
+	_, err := r.msg.ReplyText(text)
+	return err
+}
+
+// ReplyImage uploads the image through a temporary file, openwechat only
+// accepts *os.File for media messages.
+func (r *replier) ReplyImage(image []byte) error {
+	return withTempFile("wechatgpt-*.png", image, func(f *os.File) error {
+		_, err := r.msg.ReplyImage(f)
+		return err
+	})
+}
+
+func (r *replier) ReplyFile(name string, data []byte) error {
+	dir, err := os.MkdirTemp("", "wechatgpt-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, filepath.Base(name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeAndRewind(f, data); err != nil {
+		return err
+	}
+
+	_, err = r.msg.ReplyFile(f)
+	return err
+}
+
+func withTempFile(pattern string, data []byte, fn func(f *os.File) error) error {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := writeAndRewind(f, data); err != nil {
+		return err
+	}
+
+	return fn(f)
+}
+
+func writeAndRewind(f *os.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, 0)
+	return err
+}
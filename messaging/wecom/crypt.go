@@ -0,0 +1,89 @@
+package wecom
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrInvalidMessage   = errors.New("invalid encrypted message")
+)
+
+// crypt verifies and decrypts callback messages as described by
+// https://developer.work.weixin.qq.com/document/path/90968
+type crypt struct {
+	token  string
+	key    []byte
+	corpID string
+}
+
+func newCrypt(token, encodingAESKey, corpID string) (*crypt, error) {
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("EncodingAESKey must be 43 characters")
+	}
+
+	return &crypt{token: token, key: key, corpID: corpID}, nil
+}
+
+func (c *crypt) signature(timestamp, nonce, encrypted string) string {
+	parts := []string{c.token, timestamp, nonce, encrypted}
+	sort.Strings(parts)
+
+	sum := sha1.Sum([]byte(strings.Join(parts, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Decrypt verifies the signature of encrypted and returns the message in it.
+func (c *crypt) Decrypt(signature, timestamp, nonce, encrypted string) ([]byte, error) {
+	if subtle.ConstantTimeCompare([]byte(c.signature(timestamp, nonce, encrypted)), []byte(signature)) != 1 {
+		return nil, ErrInvalidSignature
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, ErrInvalidMessage
+	}
+
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCDecrypter(block, c.key[:aes.BlockSize]).CryptBlocks(data, data)
+
+	// PKCS#7 padded to 32 bytes
+	pad := int(data[len(data)-1])
+	if pad < 1 || pad > 32 || pad > len(data) {
+		return nil, ErrInvalidMessage
+	}
+	data = data[:len(data)-pad]
+
+	// 16 random bytes, 4 bytes message length, message, receiver ID
+	if len(data) < 20 {
+		return nil, ErrInvalidMessage
+	}
+	size := int(binary.BigEndian.Uint32(data[16:20]))
+	if 20+size > len(data) {
+		return nil, ErrInvalidMessage
+	}
+	if receiver := string(data[20+size:]); receiver != c.corpID {
+		return nil, errors.New("message for another corp: " + receiver)
+	}
+
+	return data[20 : 20+size], nil
+}
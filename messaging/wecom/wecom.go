@@ -0,0 +1,517 @@
+// Package wecom is the messaging adapter of WeCom (Enterprise WeChat)
+// applications, receiving messages from the callback and replying through
+// the send message API.
+package wecom
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/duo/wechatgpt/messaging"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	DefaultAPIAddr = "https://qyapi.weixin.qq.com"
+
+	// IDPrefix keeps WeCom IDs apart from the ones of other platforms
+	IDPrefix = "wecom:"
+
+	requestTimeout     = time.Minute
+	tokenRefreshMargin = 5 * time.Minute
+	maxBodySize        = 1 << 20
+	messageBacklog     = 256
+
+	// Callbacks signed further from now are rejected as replays
+	maxClockSkew = 5 * time.Minute
+	// Retried callbacks carry the MsgId of the first attempt
+	seenMsgTTL = 2 * maxClockSkew
+
+	// The access token expired or was revoked
+	errCodeInvalidToken = 40014
+	errCodeExpiredToken = 42001
+
+	// WeCom rejects longer text messages, counted in bytes
+	maxMessageLength = 2048
+
+	msgTypeText = "text"
+	toAll       = "@all"
+)
+
+type Config struct {
+	APIAddr        string
+	CorpID         string
+	AgentID        int64
+	Secret         string
+	Token          string
+	EncodingAESKey string
+}
+
+type Adapter struct {
+	config Config
+	crypt  *crypt
+	client *http.Client
+
+	// messages are handed to the handler by Run in the order received
+	messages chan *callbackMessage
+	alive    atomic.Bool
+	done     chan struct{}
+	once     sync.Once
+
+	tokenLock   sync.Mutex
+	token       string
+	tokenExpire time.Time
+
+	seenLock sync.Mutex
+	seen     map[string]time.Time
+}
+
+func New(config Config) (*Adapter, error) {
+	if config.APIAddr == "" {
+		config.APIAddr = DefaultAPIAddr
+	}
+	config.APIAddr = strings.TrimSuffix(config.APIAddr, "/")
+
+	c, err := newCrypt(config.Token, config.EncodingAESKey, config.CorpID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.AddSecret(config.Secret)
+	log.AddSecret(config.EncodingAESKey)
+
+	return &Adapter{
+		config:   config,
+		crypt:    c,
+		client:   &http.Client{Timeout: requestTimeout},
+		messages: make(chan *callbackMessage, messageBacklog),
+		done:     make(chan struct{}),
+		seen:     make(map[string]time.Time),
+	}, nil
+}
+
+type envelope struct {
+	Encrypt string `xml:"Encrypt"`
+}
+
+type callbackMessage struct {
+	ToUserName   string `xml:"ToUserName"`
+	FromUserName string `xml:"FromUserName"`
+	MsgType      string `xml:"MsgType"`
+	Content      string `xml:"Content"`
+	MsgId        string `xml:"MsgId"`
+	AgentID      int64  `xml:"AgentID"`
+}
+
+func (a *Adapter) Name() string {
+	return "wecom"
+}
+
+// Run checks the credentials and serves the callback until stopped, the
+// callback must be routed to the adapter as an http.Handler.
+func (a *Adapter) Run(handler messaging.Handler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	_, err := a.accessToken(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("login error: %w", err)
+	}
+
+	a.alive.Store(true)
+	log.Infof("WeCom agent %d started", a.config.AgentID)
+
+	for {
+		select {
+		case msg := <-a.messages:
+			a.handle(msg, handler)
+		case <-a.done:
+			return nil
+		}
+	}
+}
+
+func (a *Adapter) Stop() error {
+	a.alive.Store(false)
+	a.once.Do(func() {
+		close(a.done)
+	})
+	return nil
+}
+
+func (a *Adapter) Alive() bool {
+	return a.alive.Load()
+}
+
+// ServeHTTP answers the URL verification (GET) and receives messages (POST)
+// of the WeCom callback.
+func (a *Adapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	signature := query.Get("msg_signature")
+	timestamp := query.Get("timestamp")
+	nonce := query.Get("nonce")
+
+	if !fresh(timestamp) {
+		log.Warnf("Rejected WeCom callback with timestamp %q", timestamp)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		echo, err := a.crypt.Decrypt(signature, timestamp, nonce, query.Get("echostr"))
+		if err != nil {
+			log.Warnf("Failed to verify WeCom callback: %v", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write(echo)
+	case http.MethodPost:
+		var env envelope
+		if err := xml.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&env); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		data, err := a.crypt.Decrypt(signature, timestamp, nonce, env.Encrypt)
+		if err != nil {
+			log.Warnf("Failed to decrypt WeCom message: %v", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var msg callbackMessage
+		if err := xml.Unmarshal(data, &msg); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		// Answer at once, WeCom retries callbacks not answered in 5 seconds
+		w.WriteHeader(http.StatusOK)
+
+		if msg.AgentID != a.config.AgentID {
+			log.Warnf("Skip WeCom message for agent %d", msg.AgentID)
+			return
+		}
+		if a.duplicate(msg.MsgId) {
+			log.Debugf("Skip retried WeCom message %s", msg.MsgId)
+			return
+		}
+
+		if a.alive.Load() {
+			select {
+			case a.messages <- &msg:
+			case <-a.done:
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// fresh reports whether the callback timestamp is close to now.
+func fresh(timestamp string) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	skew := time.Since(time.Unix(sec, 0))
+	return skew > -maxClockSkew && skew < maxClockSkew
+}
+
+// duplicate reports whether the message was received before, remembering
+// it otherwise.
+func (a *Adapter) duplicate(msgID string) bool {
+	if msgID == "" {
+		return false
+	}
+
+	a.seenLock.Lock()
+	defer a.seenLock.Unlock()
+
+	now := time.Now()
+	for id, received := range a.seen {
+		if now.Sub(received) > seenMsgTTL {
+			delete(a.seen, id)
+		}
+	}
+
+	if _, ok := a.seen[msgID]; ok {
+		return true
+	}
+	a.seen[msgID] = now
+	return false
+}
+
+func (a *Adapter) handle(msg *callbackMessage, handler messaging.Handler) {
+	if msg.MsgType != msgTypeText {
+		log.Debugf("Skip WeCom %s message", msg.MsgType)
+		return
+	}
+
+	// Application messages are always private
+	id := IDPrefix + msg.FromUserName
+	handler(&messaging.Message{
+		Replier: &replier{adapter: a, user: msg.FromUserName},
+		Adapter: a,
+		ChatID:  id,
+		Sender:  messaging.User{ID: id, Name: msg.FromUserName},
+		Text:    strings.TrimSpace(msg.Content),
+	})
+}
+
+func (a *Adapter) SendText(userID string, text string) error {
+	if !strings.HasPrefix(userID, IDPrefix) {
+		return errors.New("not a WeCom ID: " + userID)
+	}
+	return (&replier{adapter: a, user: strings.TrimPrefix(userID, IDPrefix)}).ReplyText(text)
+}
+
+func (a *Adapter) SendImage(userID string, image []byte) error {
+	if !strings.HasPrefix(userID, IDPrefix) {
+		return errors.New("not a WeCom ID: " + userID)
+	}
+	return (&replier{adapter: a, user: strings.TrimPrefix(userID, IDPrefix)}).ReplyImage(image)
+}
+
+// ResolveUser accepts a WeCom user ID with or without prefix.
+func (a *Adapter) ResolveUser(name string) string {
+	if strings.HasPrefix(name, IDPrefix) {
+		return name
+	}
+	return IDPrefix + name
+}
+
+func (a *Adapter) Broadcast(text string) error {
+	return (&replier{adapter: a, user: toAll}).ReplyText(text)
+}
+
+// accessToken returns the cached access token, fetching a new one when it
+// is about to expire.
+func (a *Adapter) accessToken(ctx context.Context) (string, error) {
+	a.tokenLock.Lock()
+	defer a.tokenLock.Unlock()
+
+	if a.token != "" && time.Now().Add(tokenRefreshMargin).Before(a.tokenExpire) {
+		return a.token, nil
+	}
+
+	query := url.Values{
+		"corpid":     {a.config.CorpID},
+		"corpsecret": {a.config.Secret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.config.APIAddr+"/cgi-bin/gettoken?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		apiResponse
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := a.do(req, &resp); err != nil {
+		return "", err
+	}
+
+	log.AddSecret(resp.AccessToken)
+	a.token = resp.AccessToken
+	a.tokenExpire = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+
+	return a.token, nil
+}
+
+// invalidateToken drops token from the cache unless it was replaced already.
+func (a *Adapter) invalidateToken(token string) {
+	a.tokenLock.Lock()
+	defer a.tokenLock.Unlock()
+
+	if a.token == token {
+		a.token = ""
+	}
+}
+
+// APIError is an error answered by the WeCom API.
+type APIError struct {
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("WeCom error %d: %s", e.Code, e.Message)
+}
+
+type apiResponse struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (r *apiResponse) err() error {
+	if r.ErrCode != 0 {
+		return &APIError{Code: r.ErrCode, Message: r.ErrMsg}
+	}
+	return nil
+}
+
+type apiResult interface {
+	err() error
+}
+
+func (a *Adapter) do(req *http.Request, out apiResult) error {
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return err
+	}
+	return out.err()
+}
+
+// post sends a request to an API authenticated by the access token, once
+// more with a new token if it was rejected.
+func (a *Adapter) post(path string, contentType string, body []byte, out apiResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := a.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.APIAddr+path+sep+"access_token="+url.QueryEscape(token), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+
+		err = a.do(req, out)
+
+		var apiErr *APIError
+		if attempt == 0 && errors.As(err, &apiErr) &&
+			(apiErr.Code == errCodeInvalidToken || apiErr.Code == errCodeExpiredToken) {
+			log.Warnf("WeCom access token is rejected, fetching a new one: %v", err)
+			a.invalidateToken(token)
+			continue
+		}
+		return err
+	}
+}
+
+func (a *Adapter) send(message map[string]interface{}) error {
+	message["agentid"] = a.config.AgentID
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	var resp apiResponse
+	return a.post("/cgi-bin/message/send", "application/json", body, &resp)
+}
+
+// upload uploads data as temporary media and returns its ID.
+func (a *Adapter) upload(mediaType, name string, data []byte) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("media", name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		apiResponse
+		MediaID string `json:"media_id"`
+	}
+	if err := a.post("/cgi-bin/media/upload?type="+mediaType, w.FormDataContentType(), body.Bytes(), &resp); err != nil {
+		return "", err
+	}
+
+	return resp.MediaID, nil
+}
+
+type replier struct {
+	adapter *Adapter
+	user    string
+}
+
+func (r *replier) ReplyText(text string) error {
+	for _, chunk := range split(text) {
+		if err := r.adapter.send(map[string]interface{}{
+			"touser":  r.user,
+			"msgtype": msgTypeText,
+			"text":    map[string]string{"content": chunk},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *replier) ReplyImage(image []byte) error {
+	return r.sendMedia("image", "image.png", image)
+}
+
+func (r *replier) ReplyFile(name string, data []byte) error {
+	return r.sendMedia("file", name, data)
+}
+
+func (r *replier) sendMedia(mediaType, name string, data []byte) error {
+	mediaID, err := r.adapter.upload(mediaType, name, data)
+	if err != nil {
+		return err
+	}
+
+	return r.adapter.send(map[string]interface{}{
+		"touser":  r.user,
+		"msgtype": mediaType,
+		mediaType: map[string]string{"media_id": mediaID},
+	})
+}
+
+// split cuts text into messages WeCom accepts without breaking a character.
+func split(text string) []string {
+	var chunks []string
+	for len(text) > maxMessageLength {
+		cut := maxMessageLength
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+	return append(chunks, text)
+}
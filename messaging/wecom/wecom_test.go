@@ -0,0 +1,206 @@
+package wecom
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/duo/wechatgpt/messaging"
+)
+
+// The sample of https://developer.work.weixin.qq.com/document/path/90968
+const (
+	sampleToken  = "QDG6eK"
+	sampleAESKey = "jWmYm7qr5nMoAUwZRjGtBxmz3KA1tkAj3ykkR6q2B2C"
+	sampleCorpID = "wx5823bf96d3bd56c7"
+
+	testAgentID = 218
+	testTimeout = 5 * time.Second
+)
+
+func TestDecryptSample(t *testing.T) {
+	c, err := newCrypt(sampleToken, sampleAESKey, sampleCorpID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		signature = "5c45ff5e21c57e6ad56bac8758b79b1d9ac89fd3"
+		timestamp = "1409659589"
+		nonce     = "263014780"
+		echo      = "P9nAzCzyDtyTWESHep1vC5X9xho/qYX3Zpb4yKa9SKld1DsH3Iyt3tP3zNdtp+4RPcs8TgAE7OaBO+FZXvnaqQ=="
+	)
+
+	data, err := c.Decrypt(signature, timestamp, nonce, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1616140317555161061" {
+		t.Errorf("unexpected echo %q", data)
+	}
+
+	if _, err := c.Decrypt("0"+signature[1:], timestamp, nonce, echo); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expect invalid signature, got %v", err)
+	}
+	if _, err := c.Decrypt(signature, timestamp, "1"+nonce, echo); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expect invalid signature, got %v", err)
+	}
+}
+
+func TestDecryptOtherCorp(t *testing.T) {
+	c, err := newCrypt(sampleToken, sampleAESKey, sampleCorpID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := encrypt(c, "other-corp", []byte("hello"))
+	if _, err := c.Decrypt(c.signature("1", "2", encrypted), "1", "2", encrypted); err == nil {
+		t.Error("message of another corp is accepted")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	a := newTestAdapter(t)
+	received := run(t, a)
+
+	for i, content := range []string{"one", "two", "three"} {
+		if code := post(a, textMessage(strconv.Itoa(i), content, testAgentID), time.Now()); code != http.StatusOK {
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	for _, content := range []string{"one", "two", "three"} {
+		if msg := receive(t, received); msg.Text != content || msg.Sender.ID != IDPrefix+"zhangsan" {
+			t.Errorf("unexpected message %+v, expect %q", msg, content)
+		}
+	}
+
+	// Retries, other agents and replays are dropped
+	post(a, textMessage("0", "one", testAgentID), time.Now())
+	post(a, textMessage("10", "other agent", testAgentID+1), time.Now())
+	if code := post(a, textMessage("11", "replay", testAgentID), time.Now().Add(-time.Hour)); code != http.StatusForbidden {
+		t.Errorf("expect 403 for a stale timestamp, got %d", code)
+	}
+	post(a, textMessage("12", "last", testAgentID), time.Now())
+
+	if msg := receive(t, received); msg.Text != "last" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestServeHTTPVerifyURL(t *testing.T) {
+	a := newTestAdapter(t)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	echo := encrypt(a.crypt, sampleCorpID, []byte("echo-1234"))
+	query := url.Values{
+		"msg_signature": {a.crypt.signature(timestamp, "nonce", echo)},
+		"timestamp":     {timestamp},
+		"nonce":         {"nonce"},
+		"echostr":       {echo},
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/wecom?"+query.Encode(), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "echo-1234" {
+		t.Errorf("unexpected answer %d %q", w.Code, w.Body.String())
+	}
+}
+
+func newTestAdapter(t *testing.T) *Adapter {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"errcode":0,"access_token":"token","expires_in":7200}`)
+	}))
+	t.Cleanup(api.Close)
+
+	a, err := New(Config{
+		APIAddr:        api.URL,
+		CorpID:         sampleCorpID,
+		AgentID:        testAgentID,
+		Token:          sampleToken,
+		EncodingAESKey: sampleAESKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// run runs a until the test ends and returns where messages are handed.
+func run(t *testing.T, a *Adapter) <-chan *messaging.Message {
+	received := make(chan *messaging.Message, 16)
+	go a.Run(func(msg *messaging.Message) {
+		received <- msg
+	})
+	t.Cleanup(func() { a.Stop() })
+
+	deadline := time.Now().Add(testTimeout)
+	for !a.Alive() {
+		if time.Now().After(deadline) {
+			t.Fatal("adapter is not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return received
+}
+
+func receive(t *testing.T, received <-chan *messaging.Message) *messaging.Message {
+	t.Helper()
+
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("no message is received")
+		return nil
+	}
+}
+
+func textMessage(id, content string, agentID int) string {
+	return fmt.Sprintf("<xml><ToUserName><![CDATA[%s]]></ToUserName><FromUserName><![CDATA[zhangsan]]></FromUserName>"+
+		"<MsgType><![CDATA[text]]></MsgType><Content><![CDATA[%s]]></Content><MsgId>%s</MsgId><AgentID>%d</AgentID></xml>",
+		sampleCorpID, content, id, agentID)
+}
+
+// post sends message to the callback like WeCom does at time sent.
+func post(a *Adapter, message string, sent time.Time) int {
+	timestamp := strconv.FormatInt(sent.Unix(), 10)
+	encrypted := encrypt(a.crypt, sampleCorpID, []byte(message))
+	query := url.Values{
+		"msg_signature": {a.crypt.signature(timestamp, "nonce", encrypted)},
+		"timestamp":     {timestamp},
+		"nonce":         {"nonce"},
+	}
+	body := fmt.Sprintf("<xml><ToUserName><![CDATA[%s]]></ToUserName><Encrypt><![CDATA[%s]]></Encrypt></xml>", sampleCorpID, encrypted)
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/wecom?"+query.Encode(), bytes.NewBufferString(body)))
+	return w.Code
+}
+
+// encrypt is the reverse of crypt.Decrypt, as done by WeCom.
+func encrypt(c *crypt, receiver string, message []byte) string {
+	var data bytes.Buffer
+	data.Write(bytes.Repeat([]byte("r"), 16))
+	binary.Write(&data, binary.BigEndian, uint32(len(message)))
+	data.Write(message)
+	data.WriteString(receiver)
+
+	pad := 32 - data.Len()%32
+	data.Write(bytes.Repeat([]byte{byte(pad)}, pad))
+
+	block, _ := aes.NewCipher(c.key)
+	encrypted := make([]byte, data.Len())
+	cipher.NewCBCEncrypter(block, c.key[:aes.BlockSize]).CryptBlocks(encrypted, data.Bytes())
+
+	return base64.StdEncoding.EncodeToString(encrypted)
+}
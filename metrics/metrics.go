@@ -0,0 +1,109 @@
+// Package metrics defines the Prometheus metrics of the bot.
+package metrics
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "wechatgpt"
+
+	// senderBuckets bounds the series of the per-sender queue depth
+	senderBuckets = 16
+)
+
+var (
+	TasksReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_received_total",
+		Help:      "Tasks received by the task manager.",
+	})
+	TasksCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_completed_total",
+		Help:      "Tasks answered by ChatGPT.",
+	})
+	TasksFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tasks_failed_total",
+		Help:      "Failed tasks by error type.",
+	}, []string{"error"})
+
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Tasks waiting in every queue.",
+	})
+	QueueDepthBySender = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth_by_sender",
+		Help:      "Tasks waiting in the queues of the senders hashed to a bucket.",
+	}, []string{"bucket"})
+	Workers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers",
+		Help:      "Workers started by the task manager, one per sender.",
+	})
+	ActiveWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers_active",
+		Help:      "Workers currently handling a task.",
+	})
+
+	BackendFirstByte = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_first_byte_seconds",
+		Help:      "Time from sending a message to ChatGPT until the first event.",
+		Buckets:   []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60},
+	})
+	BackendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_duration_seconds",
+		Help:      "Time from sending a message to ChatGPT until the full answer.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 30, 60, 90, 120, 180},
+	})
+
+	TokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Access token refreshes by result.",
+	}, []string{"result"})
+	LoginAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_attempts_total",
+		Help:      "ChatGPT password logins by result.",
+	}, []string{"result"})
+
+	ReplyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reply_failures_total",
+		Help:      "Replies failed to be sent by messaging adapter.",
+	}, []string{"adapter"})
+)
+
+// SenderBucket is the bucket label value of sender, a hash which keeps
+// the series bounded and IDs out of the metrics.
+func SenderBucket(sender string) string {
+	h := fnv.New32a()
+	h.Write([]byte(sender))
+	return strconv.Itoa(int(h.Sum32() % senderBuckets))
+}
+
+// Result is the label value of an operation result.
+func Result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
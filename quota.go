@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+
+	"github.com/duo/wechatgpt/chatgpt"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const defaultQuotaStore = "quota.json"
+
+func loadQuotaConfig() *chatgpt.QuotaConfig {
+	if path := os.Getenv("QUOTA_CONFIG"); path != "" {
+		config, err := chatgpt.LoadQuotaConfig(path)
+		if err != nil {
+			log.Fatalf("Failed to load quota config: %v", err)
+		}
+		return config
+	}
+
+	limit := chatgpt.QuotaLimit{
+		RequestsPerMinute: getEnvInt("QUOTA_RPM", 0),
+		RequestsPerDay:    getEnvInt("QUOTA_RPD", 0),
+		TokensPerDay:      getEnvInt("QUOTA_TPD", 0),
+	}
+	if limit == (chatgpt.QuotaLimit{}) {
+		return nil
+	}
+
+	return &chatgpt.QuotaConfig{Default: limit}
+}
+
+func initQuota(taskManager *chatgpt.TaskManager) {
+	config := loadQuotaConfig()
+	if config == nil {
+		return
+	}
+
+	store := os.Getenv("QUOTA_STORE")
+	if store == "" {
+		store = defaultQuotaStore
+	}
+
+	quotaManager, err := chatgpt.NewQuotaManager(config, store)
+	if err != nil {
+		log.Fatalf("Failed to load quota usage: %v", err)
+	}
+
+	taskManager.SetQuotaManager(quotaManager)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/duo/wechatgpt/chatgpt"
+	"github.com/duo/wechatgpt/messaging"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+const (
+	defaultShutdownGrace     = 30 * time.Second
+	defaultConversationState = "conversation_state.json"
+)
+
+var stopping atomic.Bool
+
+func shuttingDown() bool {
+	return stopping.Load()
+}
+
+// initShutdown restores the conversations saved by the previous shutdown
+// and returns the function shutting down gracefully, which SIGINT and
+// SIGTERM also trigger: new messages are ignored, running tasks and draws
+// get SHUTDOWN_GRACE to finish, queued ones are dropped with a notice,
+// conversations are saved and every adapter is stopped. The returned
+// channel is closed once done.
+func initShutdown(adapters []messaging.Adapter, taskManager *chatgpt.TaskManager) (func(reason string), <-chan struct{}) {
+	grace := defaultShutdownGrace
+	if value := os.Getenv("SHUTDOWN_GRACE"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grace = duration
+	}
+
+	statePath := os.Getenv("CONVERSATION_STATE")
+	if statePath == "" {
+		statePath = defaultConversationState
+	}
+	if err := taskManager.LoadState(statePath); err != nil {
+		log.Warnf("Failed to load conversation state: %v", err)
+	}
+
+	stopped := make(chan struct{})
+	var once sync.Once
+
+	shutdown := func(reason string) {
+		once.Do(func() {
+			log.Infof("%s, shutting down", reason)
+			stopping.Store(true)
+
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), grace)
+				defer cancel()
+
+				if err := taskManager.Shutdown(ctx); err != nil {
+					log.Warnf("Running tasks are aborted: %v", err)
+				}
+				if err := waitDraws(ctx); err != nil {
+					log.Warnf("Running draws are aborted: %v", err)
+				}
+
+				if err := taskManager.SaveState(statePath); err != nil {
+					log.Warnf("Failed to save conversation state: %v", err)
+				}
+
+				for _, adapter := range adapters {
+					if err := adapter.Stop(); err != nil {
+						log.Warnf("Failed to stop %s: %v", adapter.Name(), err)
+					}
+				}
+				close(stopped)
+			}()
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		shutdown(fmt.Sprintf("Received %v", sig))
+	}()
+
+	return shutdown, stopped
+}
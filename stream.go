@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+
+	"github.com/duo/wechatgpt/messaging"
+	"github.com/duo/wechatgpt/metrics"
+
+	log "github.com/duo/wechatgpt/logging"
+)
+
+// Platforms limit how often a message can be edited
+const streamInterval = time.Second
+
+// streamReply shows an answer while it is generated on platforms able to
+// edit sent messages. Both methods are called from the task worker.
+type streamReply struct {
+	msg     *messaging.Message
+	replier messaging.StreamReplier
+	prefix  string
+
+	stream  messaging.Stream
+	updated time.Time
+}
+
+// newStreamReply returns nil if the platform of msg can not edit messages.
+func newStreamReply(msg *messaging.Message, prefix string) *streamReply {
+	replier, ok := msg.Replier.(messaging.StreamReplier)
+	if !ok {
+		return nil
+	}
+
+	return &streamReply{msg: msg, replier: replier, prefix: prefix}
+}
+
+func (s *streamReply) progress(partial string) {
+	if time.Since(s.updated) < streamInterval {
+		return
+	}
+	s.updated = time.Now()
+
+	text := s.prefix + partial
+	if s.stream == nil {
+		stream, err := s.replier.ReplyStream(text)
+		if err != nil {
+			log.Warnf("Failed to reply: %v", err)
+			return
+		}
+		s.stream = stream
+	} else if err := s.stream.Update(text); err != nil {
+		log.Debugf("Failed to update reply: %v", err)
+	}
+}
+
+func (s *streamReply) finish(text string) {
+	if s.stream == nil {
+		replyText(s.msg, text)
+		return
+	}
+
+	if err := s.stream.Finish(text); err != nil {
+		metrics.ReplyFailures.WithLabelValues(s.msg.Adapter.Name()).Inc()
+		log.Warnf("Failed to reply: %v", err)
+	}
+}